@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// defaultQuantiles are the percentiles reported for every latency distribution, unless the
+// request asks for others.
+var defaultQuantiles = []float64{0.0, 0.5, 0.9, 0.99, 1.0}
+
+// runAggregate holds the latency distributions for a single test run, split by whether the
+// delivery was handled by the first invocation in its execution environment.
+type runAggregate struct {
+	request AnalyzeRequest
+
+	all  aggregator
+	cold aggregator
+	warm aggregator
+
+	// coldStarts holds the request IDs of cold invocations, so each cold start is counted once
+	// however many records were in its batch.
+	coldStarts map[string]bool
+
+	// groups holds a distribution per distinct combination of the group by dimensions.
+	groups map[string]aggregator
+
+	// allSample, coldSample and warmSample are reservoir samples for bootstrap intervals, only kept
+	// when the request asks for them.
+	allSample  *reservoir
+	coldSample *reservoir
+	warmSample *reservoir
+
+	// bySent and byReceived are the time series of the run, only kept when the request asks for them
+	// or, for bySent, for steady state detection.
+	bySent     *timeSeries
+	byReceived *timeSeries
+
+	// steady holds the latencies of the messages the producer did not stamp as warm-up.
+	steady         aggregator
+	warmUpMessages uint64
+
+	ordering   *orderingCheck
+	crossCheck *crossCheck
+	// invocations and slowest are fed by analyzeFilter, which has the REPORT lines and the log events
+	// the deliveries were logged in.
+	invocations *invocationAggregate
+	slowest     *slowest
+	usage       *usage
+
+	// functionMemorySize and maxBatchSize describe the consumer configuration the run was measured
+	// with, as far as it can be told from the deliveries.
+	functionMemorySize int
+	maxBatchSize       int
+
+	// runStart is the start of the run stamped by the producer, zero if it stamps none.
+	runStart time.Time
+	// firstReceived and lastReceived bound the receive times of the run, to measure its throughput.
+	firstReceived time.Time
+	lastReceived  time.Time
+}
+
+func newRunAggregate(request AnalyzeRequest) *runAggregate {
+	r := &runAggregate{
+		request:     request,
+		all:         request.newAggregator(10000),
+		cold:        request.newAggregator(10000),
+		warm:        request.newAggregator(10000),
+		steady:      request.newAggregator(10000),
+		coldStarts:  make(map[string]bool),
+		groups:      make(map[string]aggregator),
+		ordering:    newOrderingCheck(),
+		slowest:     newSlowest(*request.Slowest),
+		invocations: newInvocationAggregate(request),
+		usage:       newUsage(),
+	}
+	if request.CrossCheck {
+		r.crossCheck = newCrossCheck(request.SignificantFigures)
+	}
+	if request.BucketWidth != "" || request.SteadyState {
+		r.bySent = newTimeSeries(request.bucketWidth())
+	}
+	if request.BucketWidth != "" {
+		r.byReceived = newTimeSeries(request.bucketWidth())
+	}
+	if request.Interval == intervalBootstrap {
+		size := request.ReservoirSize
+		r.allSample, r.coldSample, r.warmSample = newReservoir(size), newReservoir(size), newReservoir(size)
+	}
+	return r
+}
+
+// newAggregator creates an aggregator of the kind selected by the request. Compression is the
+// t-digest compression, which trades accuracy for size.
+func (request AnalyzeRequest) newAggregator(compression float64) aggregator {
+	return newAggregator(request.Aggregator, compression, request.SignificantFigures)
+}
+
+// bucketWidth is the width of time series buckets, 1s unless the request sets it.
+func (request AnalyzeRequest) bucketWidth() time.Duration {
+	if request.BucketWidth == "" {
+		return time.Second
+	}
+	width, _ := time.ParseDuration(request.BucketWidth)
+	return width
+}
+
+// milliseconds converts a duration to milliseconds, keeping microsecond resolution.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (r *runAggregate) add(output Output) {
+	latency := milliseconds(time.Duration(output.TimeDiffNs))
+	r.all.Add(latency)
+	r.allSample.add(latency)
+	r.ordering.add(output)
+	r.usage.add(output)
+	if output.FunctionMemorySize > r.functionMemorySize {
+		r.functionMemorySize = output.FunctionMemorySize
+	}
+	if output.BatchSize > r.maxBatchSize {
+		r.maxBatchSize = output.BatchSize
+	}
+	datum, _ := output.datum()
+	if datum.WarmUp {
+		r.warmUpMessages++
+	} else {
+		r.steady.Add(latency)
+	}
+	if runStart, ok := datum.runStartOf(); ok && r.runStart.IsZero() {
+		r.runStart = runStart
+	}
+	if sentAt, ok := datum.sentAt(); ok {
+		receivedAt := receivedAt(sentAt, output)
+		if r.firstReceived.IsZero() || receivedAt.Before(r.firstReceived) {
+			r.firstReceived = receivedAt
+		}
+		if receivedAt.After(r.lastReceived) {
+			r.lastReceived = receivedAt
+		}
+		r.bySent.add(sentAt, latency)
+		r.byReceived.add(receivedAt, latency)
+	}
+	if r.crossCheck != nil {
+		r.crossCheck.add(latency)
+	}
+	if len(r.request.GroupBy) > 0 {
+		key := groupKey(output, r.request.GroupBy)
+		if _, ok := r.groups[key]; !ok {
+			r.groups[key] = r.request.newAggregator(1000)
+		}
+		r.groups[key].Add(latency)
+	}
+	if !output.ColdStart {
+		r.warm.Add(latency)
+		r.warmSample.add(latency)
+		return
+	}
+	r.cold.Add(latency)
+	r.coldSample.add(latency)
+	r.coldStarts[output.RequestId] = true
+}
+
+func (r *runAggregate) result(testRunId string) RunResult {
+	result := RunResult{
+		TestRunId:   testRunId,
+		ColdStarts:  len(r.coldStarts),
+		All:         r.request.summarize(r.all, r.allSample),
+		Cold:        r.request.summarize(r.cold, r.coldSample),
+		Warm:        r.request.summarize(r.warm, r.warmSample),
+		Ordering:    r.ordering.result(),
+		Slowest:     r.slowest.result(),
+		Invocations: r.invocations.result(r.request),
+		Usage:       r.usage.result(),
+		Aggregator:  r.request.Aggregator,
+
+		FunctionMemorySize: r.functionMemorySize,
+		MaxBatchSize:       r.maxBatchSize,
+	}
+	result.setThroughput(r.firstReceived, r.lastReceived)
+	if !r.runStart.IsZero() {
+		runStart := r.runStart
+		result.RunStart = &runStart
+	}
+	result.Cost = estimateCost(result, region)
+	for key, group := range r.groups {
+		result.Groups = append(result.Groups, GroupResult{Group: key, Latency: r.request.summarize(group, nil)})
+	}
+	sort.Slice(result.Groups, func(i, j int) bool {
+		return result.Groups[i].Group < result.Groups[j].Group
+	})
+	if r.crossCheck != nil {
+		result.CrossCheck = r.crossCheck.result(r.request.Quantiles)
+	}
+	result.SteadyState = r.steadyState()
+	if r.request.Shape {
+		result.Shape = r.shape()
+		result.Heatmap = r.heatmap()
+	}
+	if r.request.Report {
+		result.Distribution = distribution(r.all)
+	}
+	if r.byReceived != nil {
+		result.TimeSeries = &TimeSeriesResult{
+			BucketWidth: r.request.BucketWidth,
+			BySent:      r.bySent.result(r.request.Quantiles),
+			ByReceived:  r.byReceived.result(r.request.Quantiles),
+		}
+	}
+	return result
+}
+
+// setThroughput derives the duration and throughput of a run from its first and last receive times.
+func (run *RunResult) setThroughput(firstReceived time.Time, lastReceived time.Time) {
+	if firstReceived.IsZero() {
+		return
+	}
+	run.FirstReceived = firstReceived
+	run.LastReceived = lastReceived
+	run.DurationSeconds = lastReceived.Sub(firstReceived).Seconds()
+	if run.DurationSeconds > 0 {
+		run.Throughput = float64(run.All.Count) / run.DurationSeconds
+	}
+}
+
+// summarize computes the summary of a distribution. Its percentile intervals are bootstrapped from
+// the sample if there is one, otherwise they are order statistic intervals.
+func (request AnalyzeRequest) summarize(a aggregator, sample *reservoir) LatencySummary {
+	summary := LatencySummary{Count: a.Count()}
+	if a.Count() == 0 {
+		return summary
+	}
+	summary.Mean = a.Mean()
+	summary.StdDev = a.StdDev()
+	summary.TrimmedMean = a.TrimmedMean(*request.TrimFraction, 1-*request.TrimFraction)
+	for _, quantile := range request.Quantiles {
+		summary.Percentiles = append(summary.Percentiles, Percentile{
+			Quantile: quantile,
+			Value:    a.Quantile(quantile),
+		})
+	}
+	request.addIntervals(&summary, a, sample)
+	return summary
+}
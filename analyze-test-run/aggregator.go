@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/caio/go-tdigest/v4"
+)
+
+const (
+	aggregatorTDigest = "tdigest"
+	aggregatorHdr     = "hdr"
+	aggregatorExact   = "exact"
+)
+
+// aggregator summarizes a distribution of latencies in milliseconds.
+type aggregator interface {
+	Add(value float64)
+	Quantile(q float64) float64
+	Count() uint64
+	Mean() float64
+	StdDev() float64
+	// TrimmedMean is the mean of the values between the lo and hi quantiles.
+	TrimmedMean(lo float64, hi float64) float64
+	// MarshalBinary serializes the aggregator for checkpoints, see unmarshalAggregator.
+	MarshalBinary() ([]byte, error)
+}
+
+// aggregatorState is the serialized form of an aggregator of any kind. Moments are only kept for
+// t-digests, whose serialized form does not hold them.
+type aggregatorState struct {
+	Kind    string   `json:"kind"`
+	Data    []byte   `json:"data"`
+	Moments *moments `json:"moments,omitempty"`
+}
+
+// newAggregator creates an aggregator of the given kind. Compression only applies to t-digests,
+// significantFigures only to HDR histograms.
+func newAggregator(kind string, compression float64, significantFigures int) aggregator {
+	switch kind {
+	case aggregatorHdr:
+		return newHdrAggregator(significantFigures)
+	case aggregatorExact:
+		return &exactAggregator{}
+	default:
+		digest, _ := tdigest.New(tdigest.Compression(compression))
+		return &digestAggregator{digest: digest}
+	}
+}
+
+func aggregatorKind(a aggregator) string {
+	switch a.(type) {
+	case *hdrAggregator:
+		return aggregatorHdr
+	case *exactAggregator:
+		return aggregatorExact
+	default:
+		return aggregatorTDigest
+	}
+}
+
+func marshalAggregator(a aggregator) aggregatorState {
+	data, _ := a.MarshalBinary()
+	state := aggregatorState{Kind: aggregatorKind(a), Data: data}
+	if digest, ok := a.(*digestAggregator); ok {
+		moments := digest.moments
+		state.Moments = &moments
+	}
+	return state
+}
+
+func unmarshalAggregator(state aggregatorState) (aggregator, error) {
+	switch state.Kind {
+	case aggregatorHdr:
+		histogram, err := hdrhistogram.Decode(state.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &hdrAggregator{histogram}, nil
+	case aggregatorExact:
+		a := &exactAggregator{}
+		err := json.Unmarshal(state.Data, &a.values)
+		return a, err
+	case aggregatorTDigest:
+		digest, err := tdigest.FromBytes(bytes.NewReader(state.Data))
+		if err != nil {
+			return nil, err
+		}
+		a := &digestAggregator{digest: digest}
+		if state.Moments != nil {
+			a.moments = *state.Moments
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unknown aggregator %s", state.Kind)
+	}
+}
+
+// moments are the count, mean and sum of squared deviations from the mean of the values added,
+// updated with Welford's algorithm.
+type moments struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean"`
+	M2    float64 `json:"m2"`
+}
+
+func (m *moments) add(value float64) {
+	m.Count++
+	delta := value - m.Mean
+	m.Mean += delta / float64(m.Count)
+	m.M2 += delta * (value - m.Mean)
+}
+
+// merge adds the moments of other values, see Chan et al.
+func (m *moments) merge(other moments) {
+	if other.Count == 0 {
+		return
+	}
+	count := m.Count + other.Count
+	delta := other.Mean - m.Mean
+	m.M2 += other.M2 + delta*delta*float64(m.Count)*float64(other.Count)/float64(count)
+	m.Mean += delta * float64(other.Count) / float64(count)
+	m.Count = count
+}
+
+// digestAggregator keeps the moments of the values next to the t-digest, as the centroids of the
+// digest lose the spread of the values within each of them.
+type digestAggregator struct {
+	digest  *tdigest.TDigest
+	moments moments
+}
+
+func (a *digestAggregator) Add(value float64) {
+	_ = a.digest.Add(value)
+	a.moments.add(value)
+}
+
+// merge adds the values of another t-digest aggregator.
+func (a *digestAggregator) merge(other *digestAggregator) {
+	_ = a.digest.Merge(other.digest)
+	a.moments.merge(other.moments)
+}
+
+func (a *digestAggregator) Quantile(q float64) float64 {
+	return a.digest.Quantile(q)
+}
+
+func (a *digestAggregator) Count() uint64 {
+	return a.digest.Count()
+}
+
+func (a *digestAggregator) Mean() float64 {
+	return a.digest.TrimmedMean(0, 1)
+}
+
+// StdDev is computed from the moments, or from the centroids for digests restored from states
+// without them, which underestimates it.
+func (a *digestAggregator) StdDev() float64 {
+	if a.moments.Count == a.digest.Count() && a.moments.Count > 0 {
+		return math.Sqrt(a.moments.M2 / float64(a.moments.Count))
+	}
+	mean := a.Mean()
+	var sumOfSquares float64
+	a.digest.ForEachCentroid(func(centroidMean float64, count uint64) bool {
+		sumOfSquares += float64(count) * (centroidMean - mean) * (centroidMean - mean)
+		return true
+	})
+	return math.Sqrt(sumOfSquares / float64(a.digest.Count()))
+}
+
+func (a *digestAggregator) TrimmedMean(lo float64, hi float64) float64 {
+	return a.digest.TrimmedMean(lo, hi)
+}
+
+func (a *digestAggregator) MarshalBinary() ([]byte, error) {
+	return a.digest.AsBytes()
+}
+
+// hdrMicrosPerMilli is the resolution of hdrAggregator, which records integer microseconds.
+const hdrMicrosPerMilli = 1000
+
+// maxSignificantFigures bounds the precision of hdrAggregator. A histogram over 1 microsecond to
+// 1 hour takes about 190 KB at 3 significant figures but 2.5 MB at 4 and 16 MB at 5, and a run
+// keeps a dozen of them or more, which would not fit in the 128 MB of the analyzer function.
+const maxSignificantFigures = 3
+
+// hdrAggregator records latencies in an HDR histogram between 1 microsecond and 1 hour, with
+// a relative error bounded by its number of significant figures.
+type hdrAggregator struct {
+	histogram *hdrhistogram.Histogram
+}
+
+func newHdrAggregator(significantFigures int) *hdrAggregator {
+	return &hdrAggregator{hdrhistogram.New(1, 3600*1000*hdrMicrosPerMilli, significantFigures)}
+}
+
+func (a *hdrAggregator) Add(value float64) {
+	micros := int64(math.Round(value * hdrMicrosPerMilli))
+	if micros < 1 {
+		micros = 1
+	}
+	if micros > a.histogram.HighestTrackableValue() {
+		micros = a.histogram.HighestTrackableValue()
+	}
+	_ = a.histogram.RecordValue(micros)
+}
+
+func (a *hdrAggregator) Quantile(q float64) float64 {
+	switch q {
+	case 0.0:
+		return float64(a.histogram.Min()) / hdrMicrosPerMilli
+	case 1.0:
+		return float64(a.histogram.Max()) / hdrMicrosPerMilli
+	default:
+		return float64(a.histogram.ValueAtQuantile(q*100)) / hdrMicrosPerMilli
+	}
+}
+
+func (a *hdrAggregator) Count() uint64 {
+	return uint64(a.histogram.TotalCount())
+}
+
+func (a *hdrAggregator) Mean() float64 {
+	return a.histogram.Mean() / hdrMicrosPerMilli
+}
+
+func (a *hdrAggregator) StdDev() float64 {
+	return a.histogram.StdDev() / hdrMicrosPerMilli
+}
+
+// TrimmedMean integrates the quantile function between lo and hi, which is as precise as the
+// histogram itself.
+func (a *hdrAggregator) TrimmedMean(lo float64, hi float64) float64 {
+	const steps = 1000
+	var sum float64
+	for i := 0; i < steps; i++ {
+		sum += a.Quantile(lo + (hi-lo)*(float64(i)+0.5)/steps)
+	}
+	return sum / steps
+}
+
+func (a *hdrAggregator) MarshalBinary() ([]byte, error) {
+	return a.histogram.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+}
+
+// exactAggregator keeps every value, and computes quantiles from the sorted values by linear
+// interpolation between the closest ranks. It is only suitable for small runs.
+type exactAggregator struct {
+	values []float64
+	sorted bool
+}
+
+func (a *exactAggregator) Add(value float64) {
+	a.values = append(a.values, value)
+	a.sorted = false
+}
+
+func (a *exactAggregator) Quantile(q float64) float64 {
+	if len(a.values) == 0 {
+		return math.NaN()
+	}
+	if !a.sorted {
+		sort.Float64s(a.values)
+		a.sorted = true
+	}
+	rank := q * float64(len(a.values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return a.values[lower] + (rank-float64(lower))*(a.values[upper]-a.values[lower])
+}
+
+func (a *exactAggregator) Count() uint64 {
+	return uint64(len(a.values))
+}
+
+func (a *exactAggregator) Mean() float64 {
+	return a.TrimmedMean(0, 1)
+}
+
+func (a *exactAggregator) StdDev() float64 {
+	mean := a.Mean()
+	var sumOfSquares float64
+	for _, value := range a.values {
+		sumOfSquares += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(sumOfSquares / float64(len(a.values)))
+}
+
+func (a *exactAggregator) TrimmedMean(lo float64, hi float64) float64 {
+	if !a.sorted {
+		sort.Float64s(a.values)
+		a.sorted = true
+	}
+	trimmed := a.values[int(lo*float64(len(a.values))):int(math.Ceil(hi*float64(len(a.values))))]
+	var sum float64
+	for _, value := range trimmed {
+		sum += value
+	}
+	return sum / float64(len(trimmed))
+}
+
+func (a *exactAggregator) MarshalBinary() ([]byte, error) {
+	return json.Marshal(a.values)
+}
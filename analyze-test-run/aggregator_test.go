@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestDigestAggregatorStdDev(t *testing.T) {
+	// 100,000 log-normal latencies, a wide distribution.
+	random := rand.New(rand.NewSource(1))
+	digest := newAggregator(aggregatorTDigest, 100, 0)
+	exact := newAggregator(aggregatorExact, 0, 0)
+	for i := 0; i < 100000; i++ {
+		latency := 20 * math.Exp(random.NormFloat64())
+		digest.Add(latency)
+		exact.Add(latency)
+	}
+
+	restored, err := unmarshalAggregator(marshalAggregator(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The standard deviation is the exact one, before and after the checkpoint.
+	for name, a := range map[string]aggregator{"digest": digest, "restored digest": restored} {
+		if got, want := a.StdDev(), exact.StdDev(); math.Abs(got-want) > 1e-9*want {
+			t.Errorf("expected a standard deviation of %g for the %s, got %g", want, name, got)
+		}
+	}
+}
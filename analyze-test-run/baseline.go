@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultRegressionThreshold is the relative increase of a percentile over its baseline that is
+// flagged as a regression, unless the request sets a threshold for that percentile.
+const defaultRegressionThreshold = 0.1
+
+// StoredRun is the summary of a run persisted in the results bucket, with its serialized latency
+// distribution when the run was aggregated locally, so that it can be compared long after its logs
+// have left the analysis window.
+type StoredRun struct {
+	Scenario  string           `json:"scenario"`
+	Transport string           `json:"transport"`
+	StoredAt  time.Time        `json:"stored_at"`
+	Run       RunResult        `json:"run"`
+	Latency   *aggregatorState `json:"latency,omitempty"`
+}
+
+// BaselineComparison compares the percentiles of a run against the baseline of its scenario.
+type BaselineComparison struct {
+	TestRunId   string               `json:"test_run_id"`
+	StoredAt    time.Time            `json:"stored_at"`
+	Percentiles []BaselinePercentile `json:"percentiles"`
+	Regressed   bool                 `json:"regressed"`
+}
+
+// BaselinePercentile is a percentile of a run and of its baseline, in milliseconds. Relative is the
+// relative increase over the baseline, a regression when it exceeds the threshold.
+type BaselinePercentile struct {
+	Quantile  float64 `json:"quantile"`
+	Baseline  float64 `json:"baseline"`
+	Value     float64 `json:"value"`
+	Relative  float64 `json:"relative"`
+	Threshold float64 `json:"threshold"`
+	Regressed bool    `json:"regressed"`
+}
+
+func storedRunKey(scenario string, transport string, testRunId string) string {
+	return fmt.Sprintf("runs/%s/%s/%s.json", scenario, transport, testRunId)
+}
+
+func baselineKey(scenario string, transport string) string {
+	return fmt.Sprintf("baselines/%s/%s.json", scenario, transport)
+}
+
+// loadStoredRun loads a stored run or baseline, and reports whether it exists.
+func loadStoredRun(ctx context.Context, key string) (StoredRun, bool, error) {
+	var stored StoredRun
+	err := getJSON(ctx, key, &stored)
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return stored, false, nil
+	}
+	return stored, err == nil, err
+}
+
+// threshold is the regression threshold of a quantile, see AnalyzeRequest.Thresholds.
+func (request AnalyzeRequest) threshold(quantile float64) float64 {
+	if threshold, ok := request.Thresholds[percentileName(quantile)]; ok {
+		return threshold
+	}
+	return *request.RegressionThreshold
+}
+
+// compareToBaseline compares every percentile a run shares with its baseline. The minimum and maximum
+// are left out, a single outlier would flag them.
+func (request AnalyzeRequest) compareToBaseline(run RunResult, baseline StoredRun) *BaselineComparison {
+	comparison := &BaselineComparison{TestRunId: baseline.Run.TestRunId, StoredAt: baseline.StoredAt}
+	baselineValues := make(map[float64]float64)
+	for _, percentile := range baseline.Run.All.Percentiles {
+		baselineValues[percentile.Quantile] = percentile.Value
+	}
+	for _, percentile := range run.All.Percentiles {
+		baselineValue, ok := baselineValues[percentile.Quantile]
+		if !ok || percentile.Quantile == 0 || percentile.Quantile == 1 || baselineValue == 0 {
+			continue
+		}
+		compared := BaselinePercentile{
+			Quantile:  percentile.Quantile,
+			Baseline:  baselineValue,
+			Value:     percentile.Value,
+			Relative:  (percentile.Value - baselineValue) / baselineValue,
+			Threshold: request.threshold(percentile.Quantile),
+		}
+		compared.Regressed = compared.Relative > compared.Threshold
+		comparison.Regressed = comparison.Regressed || compared.Regressed
+		comparison.Percentiles = append(comparison.Percentiles, compared)
+	}
+	return comparison
+}
+
+// storeRuns persists the runs of a transport under the scenario of the request, and compares each
+// against the baseline of the scenario. The latency distributions are taken from the scan, which is
+// why a scenario needs the filter backend. Failures are logged rather than failing the analysis.
+func storeRuns(ctx context.Context, request AnalyzeRequest, transport string, runs []RunResult, scan *filterScan) {
+	baseline, found, err := loadStoredRun(ctx, baselineKey(request.Scenario, transport))
+	if err != nil {
+		fmt.Printf("failed to load baseline of scenario %s on %s: %+v\n", request.Scenario, transport, err)
+	}
+	for i := range runs {
+		run := &runs[i]
+		stored := StoredRun{Scenario: request.Scenario, Transport: transport, StoredAt: time.Now(), Run: *run}
+		if aggregate, ok := scan.aggregation[run.TestRunId]; ok {
+			latency := marshalAggregator(aggregate.all)
+			stored.Latency = &latency
+		}
+		key := storedRunKey(request.Scenario, transport, run.TestRunId)
+		if err := putJSON(ctx, key, stored); err != nil {
+			fmt.Printf("testRunId %s, failed to store run: %+v\n", run.TestRunId, err)
+		} else {
+			fmt.Printf("testRunId %s, stored run in s3://%s/%s\n", run.TestRunId, resultsBucket, key)
+		}
+		if found && baseline.Run.TestRunId != run.TestRunId {
+			run.Baseline = request.compareToBaseline(*run, baseline)
+			printBaselineComparison(run.TestRunId, run.Baseline)
+		}
+	}
+	if !found {
+		fmt.Printf("no baseline for scenario %s on %s yet\n", request.Scenario, transport)
+	}
+}
+
+// promoteRun makes a stored run the baseline of its scenario, on every transport it was stored for.
+func promoteRun(ctx context.Context, request AnalyzeRequest) ([]string, error) {
+	var promoted []string
+	for _, transport := range request.Transports {
+		stored, found, err := loadStoredRun(ctx, storedRunKey(request.Scenario, transport, request.Promote))
+		if err != nil {
+			return promoted, err
+		}
+		if !found {
+			continue
+		}
+		if err := putJSON(ctx, baselineKey(request.Scenario, transport), stored); err != nil {
+			return promoted, err
+		}
+		fmt.Printf("testRunId %s, promoted to baseline of scenario %s on %s\n", request.Promote, request.Scenario, transport)
+		promoted = append(promoted, transport)
+	}
+	if len(promoted) == 0 {
+		return nil, fmt.Errorf("run %s of scenario %s is not stored for any transport", request.Promote, request.Scenario)
+	}
+	return promoted, nil
+}
+
+func printBaselineComparison(testRunId string, comparison *BaselineComparison) {
+	for _, percentile := range comparison.Percentiles {
+		status := "ok"
+		if percentile.Regressed {
+			status = "REGRESSION"
+		}
+		fmt.Printf("testRunId %s, baseline %s %s: baseline = %.3f, value = %.3f, change = %+.1f%% (threshold %.1f%%) %s\n",
+			testRunId, comparison.TestRunId, percentileName(percentile.Quantile), percentile.Baseline, percentile.Value,
+			percentile.Relative*100, percentile.Threshold*100, status)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// chartColors are the colors of the series of a chart, in order.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+type point struct {
+	X float64
+	Y float64
+}
+
+type chartSeries struct {
+	Name   string
+	Points []point
+}
+
+// chart lays out a plot area with axes, and maps data coordinates to SVG coordinates. Either axis
+// can be logarithmic, for latencies that span several orders of magnitude. Charts that share an x
+// axis set it with xFrom and xTo, see fit.
+type chart struct {
+	title  string
+	xLabel string
+	yLabel string
+	logX   bool
+	logY   bool
+	xFrom  float64
+	xTo    float64
+	xMin   float64
+	xMax   float64
+	yMin   float64
+	yMax   float64
+}
+
+const (
+	chartWidth  = 720
+	chartHeight = 360
+	chartLeft   = 70
+	chartRight  = 160
+	chartTop    = 30
+	chartBottom = 50
+)
+
+// fit extends the ranges of the chart to the points of the series. Points that cannot be drawn on a
+// logarithmic axis are left out. A linear y axis always starts at zero. If xTo is above xFrom, the
+// x axis spans them instead of the points.
+func (c *chart) fit(series []chartSeries) {
+	c.xMin, c.xMax, c.yMin, c.yMax = math.Inf(1), math.Inf(-1), 0, math.Inf(-1)
+	if c.logY {
+		c.yMin = math.Inf(1)
+	}
+	for _, s := range series {
+		for _, p := range s.Points {
+			if c.logX && p.X <= 0 || c.logY && p.Y <= 0 {
+				continue
+			}
+			c.xMin, c.xMax = math.Min(c.xMin, p.X), math.Max(c.xMax, p.X)
+			c.yMin, c.yMax = math.Min(c.yMin, p.Y), math.Max(c.yMax, p.Y)
+		}
+	}
+	if math.IsInf(c.xMin, 0) {
+		c.xMin, c.xMax, c.yMax = 1, 10, 1
+		if c.logY {
+			c.yMin, c.yMax = 1, 10
+		}
+	}
+	if c.xMax == c.xMin {
+		c.xMax = c.xMin * 10
+		if !c.logX {
+			c.xMax = c.xMin + 1
+		}
+	}
+	if c.yMax == c.yMin {
+		c.yMax = c.yMin + 1
+		if c.logY {
+			c.yMax = c.yMin * 10
+		}
+	}
+	if c.xTo > c.xFrom {
+		c.xMin, c.xMax = c.xFrom, c.xTo
+	}
+}
+
+func (c *chart) x(value float64) float64 {
+	position := (value - c.xMin) / (c.xMax - c.xMin)
+	if c.logX {
+		position = (math.Log10(value) - math.Log10(c.xMin)) / (math.Log10(c.xMax) - math.Log10(c.xMin))
+	}
+	return chartLeft + position*(chartWidth-chartLeft-chartRight)
+}
+
+func (c *chart) y(value float64) float64 {
+	position := (value - c.yMin) / (c.yMax - c.yMin)
+	if c.logY {
+		position = (math.Log10(value) - math.Log10(c.yMin)) / (math.Log10(c.yMax) - math.Log10(c.yMin))
+	}
+	return chartHeight - chartBottom - position*(chartHeight-chartTop-chartBottom)
+}
+
+// linearTicks returns about five round values between min and max.
+func linearTicks(min float64, max float64) []float64 {
+	step := math.Pow(10, math.Floor(math.Log10((max-min)/5)))
+	for _, multiple := range []float64{1, 2, 5, 10} {
+		if (max-min)/(step*multiple) <= 6 {
+			step *= multiple
+			break
+		}
+	}
+	var ticks []float64
+	for tick := math.Ceil(min/step) * step; tick <= max+step/1e6; tick += step {
+		ticks = append(ticks, tick)
+	}
+	return ticks
+}
+
+// logTicks returns the powers of ten between min and max.
+func logTicks(min float64, max float64) []float64 {
+	var ticks []float64
+	for exponent := math.Floor(math.Log10(min)); exponent <= math.Ceil(math.Log10(max)); exponent++ {
+		if tick := math.Pow(10, exponent); tick >= min && tick <= max {
+			ticks = append(ticks, tick)
+		}
+	}
+	if len(ticks) < 2 {
+		return linearTicks(min, max)
+	}
+	return ticks
+}
+
+func formatTick(value float64) string {
+	return strconv.FormatFloat(value, 'g', 4, 64)
+}
+
+// axes draws the frame, ticks, labels and title of the chart.
+func (c *chart) axes(svg *strings.Builder) {
+	left, right := float64(chartLeft), float64(chartWidth-chartRight)
+	top, bottom := float64(chartTop), float64(chartHeight-chartBottom)
+	fmt.Fprintf(svg, `<text x="%.1f" y="18" text-anchor="middle" font-weight="bold">%s</text>`, (left+right)/2, html.EscapeString(c.title))
+	fmt.Fprintf(svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="none" stroke="#999"/>`, left, top, right-left, bottom-top)
+	xTicks := linearTicks(c.xMin, c.xMax)
+	if c.logX {
+		xTicks = logTicks(c.xMin, c.xMax)
+	}
+	for _, tick := range xTicks {
+		x := c.x(tick)
+		fmt.Fprintf(svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#eee"/>`, x, top, x, bottom)
+		fmt.Fprintf(svg, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`, x, bottom+16, formatTick(tick))
+	}
+	yTicks := linearTicks(c.yMin, c.yMax)
+	if c.logY {
+		yTicks = logTicks(c.yMin, c.yMax)
+	}
+	for _, tick := range yTicks {
+		y := c.y(tick)
+		fmt.Fprintf(svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#eee"/>`, left, y, right, y)
+		fmt.Fprintf(svg, `<text x="%.1f" y="%.1f" text-anchor="end">%s</text>`, left-6, y+4, formatTick(tick))
+	}
+	fmt.Fprintf(svg, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`, (left+right)/2, bottom+38, html.EscapeString(c.xLabel))
+	fmt.Fprintf(svg, `<text x="16" y="%.1f" text-anchor="middle" transform="rotate(-90 16 %.1f)">%s</text>`, (top+bottom)/2, (top+bottom)/2, html.EscapeString(c.yLabel))
+}
+
+// legend lists the names of the series to the right of the plot area.
+func (c *chart) legend(svg *strings.Builder, series []chartSeries) {
+	for i, s := range series {
+		y := float64(chartTop + 14 + 18*i)
+		fmt.Fprintf(svg, `<rect x="%d" y="%.1f" width="12" height="12" fill="%s"/>`, chartWidth-chartRight+12, y-10, chartColors[i%len(chartColors)])
+		fmt.Fprintf(svg, `<text x="%d" y="%.1f">%s</text>`, chartWidth-chartRight+30, y, html.EscapeString(s.Name))
+	}
+}
+
+func svgOpen(svg *strings.Builder) {
+	fmt.Fprintf(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`, chartWidth, chartHeight)
+}
+
+// lineChart renders series as lines, e.g. CDFs or percentiles over time.
+func lineChart(c chart, series []chartSeries) template.HTML {
+	c.fit(series)
+	var svg strings.Builder
+	svgOpen(&svg)
+	c.axes(&svg)
+	for i, s := range series {
+		var points []string
+		for _, p := range s.Points {
+			if c.logX && p.X <= 0 {
+				continue
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", c.x(p.X), c.y(p.Y)))
+		}
+		fmt.Fprintf(&svg, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`, chartColors[i%len(chartColors)], strings.Join(points, " "))
+	}
+	c.legend(&svg, series)
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+// histogramChart renders bins as bars, each point being the lower edge of a bin and the fraction of
+// values in it. The last point is the upper edge of the last bin.
+func histogramChart(c chart, bins []point) template.HTML {
+	c.fit([]chartSeries{{Points: bins}})
+	var svg strings.Builder
+	svgOpen(&svg)
+	c.axes(&svg)
+	for i := 0; i+1 < len(bins); i++ {
+		x0, x1 := c.x(bins[i].X), c.x(bins[i+1].X)
+		y := c.y(bins[i].Y)
+		fmt.Fprintf(&svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" stroke="white" stroke-width="0.5"/>`,
+			x0, y, math.Max(x1-x0, 0), c.y(0)-y, chartColors[0])
+	}
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+// heatmapChart renders the cells of a heatmap, shading each by its count relative to the largest.
+// Columns start at xs and rows at ys, the last value of each being the end of the last column or
+// row; counts holds a row of counts per column.
+func heatmapChart(c chart, xs []float64, ys []float64, counts [][]uint64) template.HTML {
+	c.fit([]chartSeries{{Points: []point{{X: xs[0], Y: ys[0]}, {X: xs[len(xs)-1], Y: ys[len(ys)-1]}}}})
+	var highest uint64
+	for _, column := range counts {
+		for _, count := range column {
+			if count > highest {
+				highest = count
+			}
+		}
+	}
+	var svg strings.Builder
+	svgOpen(&svg)
+	c.axes(&svg)
+	for i, column := range counts {
+		x0, x1 := c.x(xs[i]), c.x(xs[i+1])
+		for k, count := range column {
+			if count == 0 {
+				continue
+			}
+			y0, y1 := c.y(ys[k]), c.y(ys[k+1])
+			fmt.Fprintf(&svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="%.3f"><title>%d</title></rect>`,
+				x0, y1, math.Max(x1-x0, 0), math.Max(y0-y1, 0), chartColors[0], 0.1+0.9*float64(count)/float64(highest), count)
+		}
+	}
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errDeadline is returned by a FilterLogEvents scan that stopped early because the invocation is
+// about to time out. The scan can be checkpointed and resumed by the next invocation.
+var errDeadline = errors.New("approaching invocation deadline")
+
+// checkpoint is everything needed to resume an analysis in a later invocation: the resolved request,
+// the transports that are already done and the progress of the scan that was interrupted.
+type checkpoint struct {
+	AnalysisId  string            `json:"analysis_id"`
+	Request     AnalyzeRequest    `json:"request"`
+	Completed   []TransportResult `json:"completed"`
+	Transport   string            `json:"transport"`
+	Progress    filterProgress    `json:"progress"`
+	Invocations int               `json:"invocations"`
+}
+
+// filterProgress is the serialized form of a suspended filterScan.
+type filterProgress struct {
+	NextToken *string                      `json:"next_token"`
+	Runs      map[string]runAggregateState `json:"runs"`
+	// ExportPart is the number of the next part of exported records, see recordExport.
+	ExportPart int `json:"export_part"`
+	// Requests are the invocations whose REPORT line has not been seen yet, see filterScan.
+	Requests map[string]*pendingInvocation `json:"requests"`
+}
+
+// runAggregateState is the serialized form of a runAggregate. The request it was created with is
+// stored once in the checkpoint rather than in every run.
+type runAggregateState struct {
+	All                aggregatorState            `json:"all"`
+	Cold               aggregatorState            `json:"cold"`
+	Warm               aggregatorState            `json:"warm"`
+	ColdStarts         []string                   `json:"cold_starts"`
+	Groups             map[string]aggregatorState `json:"groups"`
+	Ordering           orderingState              `json:"ordering"`
+	CrossCheck         *crossCheckState           `json:"cross_check,omitempty"`
+	RunStart           time.Time                  `json:"run_start"`
+	FirstReceived      time.Time                  `json:"first_received"`
+	LastReceived       time.Time                  `json:"last_received"`
+	Samples            map[string]*reservoir      `json:"samples,omitempty"`
+	BySent             map[string]aggregatorState `json:"by_sent,omitempty"`
+	ByReceived         map[string]aggregatorState `json:"by_received,omitempty"`
+	Steady             aggregatorState            `json:"steady"`
+	WarmUpMessages     uint64                     `json:"warm_up_messages"`
+	FunctionMemorySize int                        `json:"function_memory_size"`
+	MaxBatchSize       int                        `json:"max_batch_size"`
+	Slowest            []SlowDelivery             `json:"slowest"`
+	Invocations        invocationState            `json:"invocations"`
+	Usage              usageState                 `json:"usage"`
+}
+
+type crossCheckState struct {
+	Exact    aggregatorState `json:"exact"`
+	TDigest  aggregatorState `json:"tdigest"`
+	Hdr      aggregatorState `json:"hdr"`
+	Exceeded bool            `json:"exceeded"`
+}
+
+func (r *runAggregate) state() runAggregateState {
+	state := runAggregateState{
+		All:                marshalAggregator(r.all),
+		Cold:               marshalAggregator(r.cold),
+		Warm:               marshalAggregator(r.warm),
+		Groups:             make(map[string]aggregatorState),
+		Ordering:           r.ordering.state(),
+		RunStart:           r.runStart,
+		FirstReceived:      r.firstReceived,
+		LastReceived:       r.lastReceived,
+		BySent:             r.bySent.state(),
+		ByReceived:         r.byReceived.state(),
+		Steady:             marshalAggregator(r.steady),
+		WarmUpMessages:     r.warmUpMessages,
+		FunctionMemorySize: r.functionMemorySize,
+		MaxBatchSize:       r.maxBatchSize,
+		Slowest:            r.slowest.deliveries,
+		Invocations:        r.invocations.state(),
+		Usage:              r.usage.state(),
+	}
+	if r.allSample != nil {
+		state.Samples = map[string]*reservoir{"all": r.allSample, "cold": r.coldSample, "warm": r.warmSample}
+	}
+	for requestId := range r.coldStarts {
+		state.ColdStarts = append(state.ColdStarts, requestId)
+	}
+	for key, group := range r.groups {
+		state.Groups[key] = marshalAggregator(group)
+	}
+	if r.crossCheck != nil {
+		state.CrossCheck = &crossCheckState{Exceeded: r.crossCheck.exceeded}
+		if !r.crossCheck.exceeded {
+			state.CrossCheck.Exact = marshalAggregator(r.crossCheck.exact)
+			state.CrossCheck.TDigest = marshalAggregator(r.crossCheck.digest)
+			state.CrossCheck.Hdr = marshalAggregator(r.crossCheck.hdr)
+		}
+	}
+	return state
+}
+
+func restoreRunAggregate(request AnalyzeRequest, state runAggregateState) (*runAggregate, error) {
+	r := newRunAggregate(request)
+	var err error
+	if r.all, err = unmarshalAggregator(state.All); err != nil {
+		return nil, err
+	}
+	if r.cold, err = unmarshalAggregator(state.Cold); err != nil {
+		return nil, err
+	}
+	if r.warm, err = unmarshalAggregator(state.Warm); err != nil {
+		return nil, err
+	}
+	for _, requestId := range state.ColdStarts {
+		r.coldStarts[requestId] = true
+	}
+	r.runStart = state.RunStart
+	r.firstReceived = state.FirstReceived
+	r.lastReceived = state.LastReceived
+	if r.steady, err = unmarshalAggregator(state.Steady); err != nil {
+		return nil, err
+	}
+	r.warmUpMessages = state.WarmUpMessages
+	r.functionMemorySize = state.FunctionMemorySize
+	r.maxBatchSize = state.MaxBatchSize
+	r.slowest.restore(state.Slowest)
+	r.usage.restore(state.Usage)
+	if err := r.invocations.restore(state.Invocations); err != nil {
+		return nil, err
+	}
+	if err := r.bySent.restore(state.BySent); err != nil {
+		return nil, err
+	}
+	if err := r.byReceived.restore(state.ByReceived); err != nil {
+		return nil, err
+	}
+	if state.Samples != nil && r.allSample != nil {
+		r.allSample, r.coldSample, r.warmSample = state.Samples["all"], state.Samples["cold"], state.Samples["warm"]
+	}
+	for key, group := range state.Groups {
+		if r.groups[key], err = unmarshalAggregator(group); err != nil {
+			return nil, err
+		}
+	}
+	r.ordering.restore(state.Ordering)
+	if state.CrossCheck != nil && r.crossCheck != nil {
+		r.crossCheck.exceeded = state.CrossCheck.Exceeded
+		if r.crossCheck.exceeded {
+			r.crossCheck.exact, r.crossCheck.digest, r.crossCheck.hdr = nil, nil, nil
+		} else {
+			if r.crossCheck.exact, err = unmarshalAggregator(state.CrossCheck.Exact); err != nil {
+				return nil, err
+			}
+			if r.crossCheck.digest, err = unmarshalAggregator(state.CrossCheck.TDigest); err != nil {
+				return nil, err
+			}
+			if r.crossCheck.hdr, err = unmarshalAggregator(state.CrossCheck.Hdr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func (s *filterScan) progress() filterProgress {
+	progress := filterProgress{NextToken: s.nextToken, Runs: make(map[string]runAggregateState), Requests: s.requests}
+	if s.export != nil {
+		progress.ExportPart = s.export.part
+	}
+	for testRunId, run := range s.aggregation {
+		progress.Runs[testRunId] = run.state()
+	}
+	return progress
+}
+
+func restoreFilterScan(request AnalyzeRequest, progress filterProgress) (*filterScan, error) {
+	scan := newFilterScan()
+	scan.nextToken = progress.NextToken
+	for requestId, pending := range progress.Requests {
+		scan.requests[requestId] = pending
+	}
+	for testRunId, state := range progress.Runs {
+		run, err := restoreRunAggregate(request, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore run %s, %w", testRunId, err)
+		}
+		scan.aggregation[testRunId] = run
+	}
+	return scan, nil
+}
+
+func checkpointKey(analysisId string) string {
+	return fmt.Sprintf("checkpoints/%s.json", analysisId)
+}
+
+func resultKey(analysisId string) string {
+	return fmt.Sprintf("analyses/%s/result.json", analysisId)
+}
+
+func putJSON(ctx context.Context, key string, value interface{}) error {
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return putObject(ctx, key, serialized, "application/json")
+}
+
+func putObject(ctx context.Context, key string, body []byte, contentType string) error {
+	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(resultsBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put s3://%s/%s, %w", resultsBucket, key, err)
+	}
+	return nil
+}
+
+func getJSON(ctx context.Context, key string, value interface{}) error {
+	object, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(resultsBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get s3://%s/%s, %w", resultsBucket, key, err)
+	}
+	defer object.Body.Close()
+	serialized, err := io.ReadAll(object.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(serialized, value)
+}
+
+func loadCheckpoint(ctx context.Context, key string) (checkpoint, error) {
+	var cp checkpoint
+	err := getJSON(ctx, key, &cp)
+	return cp, err
+}
+
+func deleteCheckpoint(ctx context.Context, analysisId string) error {
+	_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(resultsBucket),
+		Key:    aws.String(checkpointKey(analysisId)),
+	})
+	return err
+}
+
+// handOff saves the checkpoint and asynchronously invokes this function again to resume from it.
+// The context passed in must still have enough time left to do both.
+func handOff(ctx context.Context, cp checkpoint) (string, error) {
+	if resultsBucket == "" {
+		return "", errors.New("RESULTS_BUCKET is not set, cannot checkpoint")
+	}
+	key := checkpointKey(cp.AnalysisId)
+	if err := putJSON(ctx, key, cp); err != nil {
+		return "", err
+	}
+	payload, _ := json.Marshal(AnalyzeRequest{CheckpointKey: key})
+	_, err := lambdaClient.Invoke(ctx, &awslambda.InvokeInput{
+		FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		InvocationType: lambdatypes.InvocationTypeEvent,
+		Payload:        payload,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to invoke next analysis, %w", err)
+	}
+	return key, nil
+}
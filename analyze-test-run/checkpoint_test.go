@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilterScanResumesFromCheckpoint(t *testing.T) {
+	contents, err := os.ReadFile(filepath.Join("testdata", "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(contents, []byte("\n"))
+	slowest := 5
+	tests := []struct {
+		name    string
+		request AnalyzeRequest
+	}{
+		{
+			name:    "tdigest with time series",
+			request: AnalyzeRequest{GroupBy: []string{"batch_index"}, BucketWidth: "1s", SteadyState: true, Shape: true, Slowest: &slowest},
+		},
+		{
+			name:    "hdr with cross check",
+			request: AnalyzeRequest{Aggregator: "hdr", CrossCheck: true},
+		},
+		{
+			name:    "bootstrap",
+			request: AnalyzeRequest{Interval: intervalBootstrap, Resamples: 200, ReservoirSize: 50},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.request.Backend = backendFilter
+			request, err := resolveRequest(test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			analyze := func(scan *filterScan, lines [][]byte) {
+				t.Helper()
+				if err := analyzeReader(context.Background(), "events.jsonl", bytes.NewReader(bytes.Join(lines, nil)), request, scan); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			uninterrupted := newFilterScan()
+			analyze(uninterrupted, lines)
+
+			// Suspend half way through, part way into the runs and with invocations still pending.
+			scan := newFilterScan()
+			analyze(scan, lines[:len(lines)/2])
+			serialized, err := json.Marshal(scan.progress())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var progress filterProgress
+			if err := json.Unmarshal(serialized, &progress); err != nil {
+				t.Fatal(err)
+			}
+			resumed, err := restoreFilterScan(request, progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			analyze(resumed, lines[len(lines)/2:])
+
+			if path, ok := sameResults(t, uninterrupted.results(), resumed.results()); !ok {
+				t.Errorf("expected the resumed scan to give the results of an uninterrupted one, %s differs", path)
+			}
+		})
+	}
+}
+
+// sameResults compares results as JSON, allowing for the float32 precision the t-digest centroids
+// are serialized with. It returns the path of the first value that differs.
+func sameResults(t *testing.T, want []RunResult, got []RunResult) (string, bool) {
+	t.Helper()
+	decode := func(results []RunResult) interface{} {
+		serialized, err := json.Marshal(results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(serialized, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	return sameJSON("", decode(want), decode(got))
+}
+
+func sameJSON(path string, want interface{}, got interface{}) (string, bool) {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got, ok := got.(map[string]interface{})
+		if !ok || len(got) != len(want) {
+			return path, false
+		}
+		for key, value := range want {
+			if path, ok := sameJSON(path+"."+key, value, got[key]); !ok {
+				return path, false
+			}
+		}
+	case []interface{}:
+		got, ok := got.([]interface{})
+		if !ok || len(got) != len(want) {
+			return path, false
+		}
+		for i, value := range want {
+			if path, ok := sameJSON(fmt.Sprintf("%s[%d]", path, i), value, got[i]); !ok {
+				return path, false
+			}
+		}
+	case float64:
+		got, ok := got.(float64)
+		if !ok || math.Abs(got-want) > 1e-6*math.Max(1, math.Abs(want)) {
+			return path, false
+		}
+	default:
+		if want != got {
+			return path, false
+		}
+	}
+	return "", true
+}
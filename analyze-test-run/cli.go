@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runCLI analyzes the request given on the command line with the same handler as the function, and
+// prints the result as JSON. The environment is read as in the function, e.g. REGION and STACK_NAME.
+// Given log files, it analyzes them offline as a single transport instead of querying CloudWatch
+// Logs, see analyzeFiles.
+func runCLI() {
+	requestJSON := flag.String("request", "{}", "analyze request as JSON, e.g. {\"test_run_ids\":[\"...\"],\"backend\":\"filter\"}")
+	flag.StringVar(&reportPath, "report", "", "write an HTML report to this path")
+	flag.StringVar(&exportDir, "export-dir", "", "write exports to this directory, in the formats of the request's export_formats")
+	transport := flag.String("transport", "file", "transport the log files were logged by, e.g. queue")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [log file ...]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Log files hold a log event per line, either as exported from CloudWatch Logs or as logged\nby the consumer; - reads stdin. Without log files, runs are analyzed from CloudWatch Logs.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		logFiles = flag.Args()
+		stackName = ""
+		logGroupNames = map[string]string{*transport: strings.Join(logFiles, ", ")}
+	}
+
+	var request AnalyzeRequest
+	if err := json.Unmarshal([]byte(*requestJSON), &request); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid request: %v\n", err)
+		os.Exit(2)
+	}
+	if reportPath != "" {
+		request.Report = true
+	}
+	result, err := handler(context.Background(), request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "analysis failed: %v\n", err)
+		os.Exit(1)
+	}
+	serialized, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(serialized))
+}
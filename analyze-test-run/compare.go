@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	verdictBetter        = "better"
+	verdictWorse         = "worse"
+	verdictNoDifference  = "no significant difference"
+	verdictNotApplicable = "not applicable"
+)
+
+// RunSelector selects the deliveries of one test run on one transport.
+type RunSelector struct {
+	TestRunId string `json:"test_run_id"`
+	Transport string `json:"transport"`
+}
+
+func (s RunSelector) String() string {
+	return s.TestRunId + " on " + s.Transport
+}
+
+// CompareRequest compares a candidate run against a baseline run, e.g. the same run on two
+// transports, or two runs on the same transport. Fields left empty in the candidate are taken from
+// the baseline.
+type CompareRequest struct {
+	Baseline  RunSelector `json:"baseline"`
+	Candidate RunSelector `json:"candidate"`
+}
+
+// CompareResult holds the percentile deltas of the candidate against the baseline, two tests of
+// whether their latency distributions differ, and the verdict on the candidate. Lower latency is
+// better.
+type CompareResult struct {
+	Baseline     RunSelector       `json:"baseline"`
+	Candidate    RunSelector       `json:"candidate"`
+	BaselineRun  RunResult         `json:"baseline_run"`
+	CandidateRun RunResult         `json:"candidate_run"`
+	Deltas       []PercentileDelta `json:"deltas"`
+	MannWhitney  TestResult        `json:"mann_whitney"`
+	Kolmogorov   TestResult        `json:"kolmogorov_smirnov"`
+	// Significance is the p-value below which the distributions are considered different, one minus
+	// the confidence level.
+	Significance float64 `json:"significance"`
+	Verdict      string  `json:"verdict"`
+}
+
+// PercentileDelta is the difference of a percentile between the candidate and the baseline, in
+// milliseconds, with a confidence interval of the difference. The interval is bootstrapped while both
+// runs fit in their reservoirs, and otherwise combined from the order statistic intervals of the runs,
+// see orderStatisticDeltaInterval.
+type PercentileDelta struct {
+	Quantile  float64             `json:"quantile"`
+	Baseline  float64             `json:"baseline"`
+	Candidate float64             `json:"candidate"`
+	Delta     float64             `json:"delta"`
+	Relative  float64             `json:"relative"`
+	Interval  *ConfidenceInterval `json:"interval,omitempty"`
+}
+
+// TestResult is the statistic and two-sided p-value of a two-sample test.
+type TestResult struct {
+	Statistic float64 `json:"statistic"`
+	PValue    float64 `json:"p_value"`
+}
+
+// resolveCompare fills in the candidate from the baseline and validates both selectors.
+func resolveCompare(compare *CompareRequest) error {
+	if compare.Candidate.TestRunId == "" {
+		compare.Candidate.TestRunId = compare.Baseline.TestRunId
+	}
+	if compare.Candidate.Transport == "" {
+		compare.Candidate.Transport = compare.Baseline.Transport
+	}
+	for _, selector := range []RunSelector{compare.Baseline, compare.Candidate} {
+		if selector.TestRunId == "" || selector.Transport == "" {
+			return errors.New("compare needs a test run ID and a transport for the baseline")
+		}
+		_, ok := logGroupNames[selector.Transport]
+		// Offline, the deliveries of either transport are told apart in the log files.
+		offline := len(logFiles) > 0 && (selector.Transport == "queue" || selector.Transport == "stream")
+		if !ok && !offline {
+			return fmt.Errorf("unknown transport %s", selector.Transport)
+		}
+	}
+	if compare.Baseline == compare.Candidate {
+		return fmt.Errorf("baseline and candidate are both %s", compare.Baseline)
+	}
+	return nil
+}
+
+// scanRun aggregates the deliveries of a single run on a single transport with FilterLogEvents, or
+// from the log files offline, keeping a sample of the latencies for the tests. Offline, the
+// deliveries of the queue and the stream are told apart by outputTransport.
+func scanRun(ctx context.Context, request AnalyzeRequest, selector RunSelector) (*runAggregate, error) {
+	request.TestRunIds = []string{selector.TestRunId}
+	request.Interval = intervalBootstrap
+	scan := newFilterScan()
+	var err error
+	if len(logFiles) > 0 {
+		if selector.Transport == "queue" || selector.Transport == "stream" {
+			scan.transport = selector.Transport
+		}
+		_, err = analyzeFiles(ctx, request, scan)
+	} else {
+		_, err = analyzeFilter(ctx, logGroupNames[selector.Transport], request, *request.StartTime, *request.EndTime, scan)
+	}
+	if errors.Is(err, errDeadline) {
+		return nil, fmt.Errorf("could not scan %s before the deadline, narrow the time range", selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+	run, ok := scan.aggregation[selector.TestRunId]
+	if !ok {
+		return nil, fmt.Errorf("no deliveries of %s", selector)
+	}
+	return run, nil
+}
+
+// compareRuns scans the baseline and the candidate run and compares their latency distributions.
+func compareRuns(ctx context.Context, request AnalyzeRequest) (*CompareResult, error) {
+	compare := request.Compare
+	baseline, err := scanRun(ctx, request, compare.Baseline)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := scanRun(ctx, request, compare.Candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CompareResult{
+		Baseline:     compare.Baseline,
+		Candidate:    compare.Candidate,
+		BaselineRun:  baseline.result(compare.Baseline.TestRunId),
+		CandidateRun: candidate.result(compare.Candidate.TestRunId),
+		Significance: 1 - request.ConfidenceLevel,
+	}
+	baselineSample, candidateSample := baseline.allSample.Values, candidate.allSample.Values
+	intervals := bootstrapDeltaIntervals(baseline.allSample, candidate.allSample, request.Quantiles, request.ConfidenceLevel, request.Resamples)
+	for i, quantile := range request.Quantiles {
+		delta := PercentileDelta{
+			Quantile:  quantile,
+			Baseline:  baseline.all.Quantile(quantile),
+			Candidate: candidate.all.Quantile(quantile),
+		}
+		delta.Delta = delta.Candidate - delta.Baseline
+		if delta.Baseline != 0 {
+			delta.Relative = delta.Delta / delta.Baseline
+		}
+		if quantile != 0 && quantile != 1 {
+			delta.Interval = intervals[i]
+			if delta.Interval == nil {
+				delta.Interval = orderStatisticDeltaInterval(baseline.all, candidate.all, quantile, request.ConfidenceLevel)
+			}
+		}
+		result.Deltas = append(result.Deltas, delta)
+	}
+
+	var probabilityLower float64
+	result.MannWhitney, probabilityLower = mannWhitney(candidateSample, baselineSample)
+	result.Kolmogorov = kolmogorovSmirnov(candidateSample, baselineSample)
+	switch {
+	case len(baselineSample) < 2 || len(candidateSample) < 2:
+		result.Verdict = verdictNotApplicable
+	case result.MannWhitney.PValue >= result.Significance:
+		result.Verdict = verdictNoDifference
+	case probabilityLower > 0.5:
+		result.Verdict = verdictBetter
+	default:
+		result.Verdict = verdictWorse
+	}
+	return result, nil
+}
+
+// bootstrapDeltaIntervals bounds the difference of each quantile between the candidate and the
+// baseline, resampling both reservoirs independently. It gives no intervals unless both reservoirs
+// hold every latency of their run: the quantiles of a reservoir of a larger run are themselves only
+// estimates of the quantiles of the run, which resamples of the reservoir do not account for. Those
+// runs are bounded with orderStatisticDeltaInterval instead.
+func bootstrapDeltaIntervals(baseline *reservoir, candidate *reservoir, quantiles []float64, level float64, resamples int) []*ConfidenceInterval {
+	if len(baseline.Values) == 0 || len(candidate.Values) == 0 || !baseline.complete() || !candidate.complete() {
+		return make([]*ConfidenceInterval, len(quantiles))
+	}
+	random := rand.New(rand.NewSource(1))
+	estimates := make([][]float64, len(quantiles))
+	baselineResample := make([]float64, len(baseline.Values))
+	candidateResample := make([]float64, len(candidate.Values))
+	for i := 0; i < resamples; i++ {
+		baselineResampled := resampleQuantiles(random, baseline.Values, baselineResample, quantiles)
+		candidateResampled := resampleQuantiles(random, candidate.Values, candidateResample, quantiles)
+		for k := range quantiles {
+			estimates[k] = append(estimates[k], candidateResampled[k]-baselineResampled[k])
+		}
+	}
+	return percentileIntervals(estimates, level)
+}
+
+// orderStatisticDeltaInterval bounds the difference of a quantile between the candidate and the
+// baseline from the order statistic interval of each, which cover every delivery of the run. The
+// distances from each estimate to its bounds are combined as those of independent estimates, see
+// Newcombe's method of variance estimates recovery (MOVER).
+func orderStatisticDeltaInterval(baseline aggregator, candidate aggregator, quantile float64, level float64) *ConfidenceInterval {
+	baselineInterval := orderStatisticInterval(baseline, quantile, level)
+	candidateInterval := orderStatisticInterval(candidate, quantile, level)
+	baselineValue, candidateValue := baseline.Quantile(quantile), candidate.Quantile(quantile)
+	delta := candidateValue - baselineValue
+	return &ConfidenceInterval{
+		Lower:  delta - math.Hypot(candidateValue-candidateInterval.Lower, baselineInterval.Upper-baselineValue),
+		Upper:  delta + math.Hypot(candidateInterval.Upper-candidateValue, baselineValue-baselineInterval.Lower),
+		Level:  level,
+		Method: intervalOrderStatistic,
+	}
+}
+
+// mannWhitney runs the Mann-Whitney U test of x against y, with the normal approximation and the
+// correction for ties. It also returns the probability that a value of x is lower than a value of y,
+// counting ties as half, which tells the direction of a significant difference.
+func mannWhitney(x []float64, y []float64) (TestResult, float64) {
+	n1, n2 := float64(len(x)), float64(len(y))
+	if n1 == 0 || n2 == 0 {
+		return TestResult{PValue: 1}, 0.5
+	}
+	type value struct {
+		value float64
+		fromX bool
+	}
+	values := make([]value, 0, len(x)+len(y))
+	for _, v := range x {
+		values = append(values, value{v, true})
+	}
+	for _, v := range y {
+		values = append(values, value{v, false})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].value < values[j].value
+	})
+
+	// Tied values share the mean of their ranks.
+	var rankSumX, tieCorrection float64
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].value == values[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if values[k].fromX {
+				rankSumX += rank
+			}
+		}
+		ties := float64(j - i)
+		tieCorrection += ties*ties*ties - ties
+		i = j
+	}
+
+	n := n1 + n2
+	u := rankSumX - n1*(n1+1)/2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - tieCorrection/(n*(n-1))))
+	result := TestResult{Statistic: u, PValue: 1}
+	if sigma > 0 {
+		z := (u - n1*n2/2) / sigma
+		result.PValue = math.Erfc(math.Abs(z) / math.Sqrt2)
+	}
+	// U counts the pairs where the value of x is higher, so the pairs where it is lower are the rest.
+	return result, 1 - u/(n1*n2)
+}
+
+// kolmogorovSmirnov runs the two-sample Kolmogorov-Smirnov test of x against y, with the asymptotic
+// distribution of the statistic.
+func kolmogorovSmirnov(x []float64, y []float64) TestResult {
+	if len(x) == 0 || len(y) == 0 {
+		return TestResult{PValue: 1}
+	}
+	x = append([]float64(nil), x...)
+	y = append([]float64(nil), y...)
+	sort.Float64s(x)
+	sort.Float64s(y)
+	var d float64
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		value := math.Min(x[i], y[j])
+		for i < len(x) && x[i] == value {
+			i++
+		}
+		for j < len(y) && y[j] == value {
+			j++
+		}
+		d = math.Max(d, math.Abs(float64(i)/float64(len(x))-float64(j)/float64(len(y))))
+	}
+
+	n1, n2 := float64(len(x)), float64(len(y))
+	en := math.Sqrt(n1 * n2 / (n1 + n2))
+	lambda := (en + 0.12 + 0.11/en) * d
+	var p float64
+	for k := 1; k <= 100; k++ {
+		term := 2 * math.Pow(-1, float64(k-1)) * math.Exp(-2*float64(k*k)*lambda*lambda)
+		p += term
+		if math.Abs(term) < 1e-10 {
+			break
+		}
+	}
+	return TestResult{Statistic: d, PValue: math.Min(math.Max(p, 0), 1)}
+}
+
+func printCompareResult(result *CompareResult) {
+	fmt.Printf("compare %s against %s\n", result.Candidate, result.Baseline)
+	for _, delta := range result.Deltas {
+		interval := ""
+		if delta.Interval != nil {
+			interval = fmt.Sprintf(" [%.3f, %.3f]", delta.Interval.Lower, delta.Interval.Upper)
+		}
+		fmt.Printf("compare %s: baseline = %.3f, candidate = %.3f, delta = %+.3f%s (%+.1f%%)\n",
+			percentileName(delta.Quantile), delta.Baseline, delta.Candidate, delta.Delta, interval, delta.Relative*100)
+	}
+	fmt.Printf("compare mann-whitney U = %.1f, p = %.4f\n", result.MannWhitney.Statistic, result.MannWhitney.PValue)
+	fmt.Printf("compare kolmogorov-smirnov D = %.4f, p = %.4f\n", result.Kolmogorov.Statistic, result.Kolmogorov.PValue)
+	fmt.Printf("compare verdict at significance %.2f: %s\n", result.Significance, result.Verdict)
+}
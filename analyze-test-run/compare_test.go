@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareTests(t *testing.T) {
+	tests := []struct {
+		name        string
+		shift       float64
+		significant bool
+	}{
+		{name: "same distribution", shift: 0, significant: false},
+		{name: "shifted by half a standard deviation", shift: 0.5, significant: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(1))
+			baseline, candidate := make([]float64, 500), make([]float64, 500)
+			for i := range baseline {
+				baseline[i] = 10 + random.NormFloat64()
+				candidate[i] = 10 + test.shift + random.NormFloat64()
+			}
+
+			mw, lower := mannWhitney(baseline, candidate)
+			ks := kolmogorovSmirnov(baseline, candidate)
+
+			// Both tests find a difference at the 1% level only when there is one.
+			if got := mw.PValue < 0.01; got != test.significant {
+				t.Errorf("expected Mann-Whitney significant = %v, got p = %g", test.significant, mw.PValue)
+			}
+			if got := ks.PValue < 0.01; got != test.significant {
+				t.Errorf("expected Kolmogorov-Smirnov significant = %v, got p = %g", test.significant, ks.PValue)
+			}
+			if test.significant && lower <= 0.5 {
+				t.Errorf("expected the baseline to be lower, got P(baseline < candidate) = %g", lower)
+			}
+		})
+	}
+}
+
+func TestMannWhitneyTies(t *testing.T) {
+	// Two identical samples made only of ties have no difference.
+	x := []float64{1, 1, 2, 2}
+
+	result, lower := mannWhitney(x, x)
+
+	if result.Statistic != 8 || result.PValue != 1 || lower != 0.5 {
+		t.Errorf("expected U = 8, p = 1 and P(x < y) = 0.5, got %+v and %g", result, lower)
+	}
+}
+
+func TestCompareRunsOfflineByTransport(t *testing.T) {
+	// The same run on the queue, at 10 ms, and on the stream, at 30 ms.
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines,
+			fmt.Sprintf(`{"test_run_id":"run","time_diff_ns":10000000,"message_number":%d}`, i),
+			fmt.Sprintf(`{"test_run_id":"run","time_diff_ns":30000000,"message_number":%d,"shard_id":"shardId-000000000000"}`, i))
+	}
+	name := filepath.Join(t.TempDir(), "mixed.jsonl")
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous []string) { logFiles = previous }(logFiles)
+	logFiles = []string{name}
+	defer func(previous map[string]string) { logGroupNames = previous }(logGroupNames)
+	logGroupNames = map[string]string{"file": name}
+	compare := &CompareRequest{
+		Baseline:  RunSelector{TestRunId: "run", Transport: "queue"},
+		Candidate: RunSelector{Transport: "stream"},
+	}
+	request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter, Compare: compare})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := compareRuns(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each side only has the deliveries of its own transport.
+	for _, side := range []struct {
+		run  RunResult
+		mean float64
+	}{{run: result.BaselineRun, mean: 10}, {run: result.CandidateRun, mean: 30}} {
+		if side.run.All.Count != 200 || side.run.All.Mean != side.mean {
+			t.Errorf("expected 200 deliveries with a mean of %g ms, got %d with %g ms",
+				side.mean, side.run.All.Count, side.run.All.Mean)
+		}
+	}
+	if result.Verdict != verdictWorse {
+		t.Errorf("expected the stream to be worse, got %s", result.Verdict)
+	}
+}
+
+func TestCompareRunsLargerThanTheReservoir(t *testing.T) {
+	// The same run on the queue, uniform on [10, 11) ms, and on the stream, 1 ms slower, with more
+	// deliveries than the reservoir holds.
+	const size = 3000
+	random := rand.New(rand.NewSource(1))
+	var lines []string
+	for i := 0; i < size; i++ {
+		lines = append(lines,
+			fmt.Sprintf(`{"test_run_id":"run","time_diff_ns":%d,"message_number":%d}`, int64((10+random.Float64())*1e6), i),
+			fmt.Sprintf(`{"test_run_id":"run","time_diff_ns":%d,"message_number":%d,"shard_id":"shardId-000000000000"}`, int64((11+random.Float64())*1e6), i))
+	}
+	name := filepath.Join(t.TempDir(), "large.jsonl")
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous []string) { logFiles = previous }(logFiles)
+	logFiles = []string{name}
+	defer func(previous map[string]string) { logGroupNames = previous }(logGroupNames)
+	logGroupNames = map[string]string{"file": name}
+	compare := &CompareRequest{
+		Baseline:  RunSelector{TestRunId: "run", Transport: "queue"},
+		Candidate: RunSelector{Transport: "stream"},
+	}
+	request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter, Compare: compare, ReservoirSize: size / 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := compareRuns(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, delta := range result.Deltas {
+		if delta.Quantile == 0 || delta.Quantile == 1 {
+			continue
+		}
+		if delta.Interval == nil {
+			t.Errorf("expected an interval for p%g", delta.Quantile*100)
+			continue
+		}
+		if delta.Interval.Method != intervalOrderStatistic {
+			t.Errorf("expected an order statistic interval for p%g, got %s", delta.Quantile*100, delta.Interval.Method)
+		}
+		if delta.Interval.Lower > delta.Delta || delta.Interval.Upper < delta.Delta || delta.Interval.Lower > 1 || delta.Interval.Upper < 1 {
+			t.Errorf("expected an interval around the delta of %g ms and the shift of 1 ms for p%g, got [%g, %g]",
+				delta.Delta, delta.Quantile*100, delta.Interval.Lower, delta.Interval.Upper)
+		}
+	}
+}
+
+func TestBootstrapDeltaIntervals(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		wantInterval bool
+	}{
+		{name: "runs within the reservoir", size: defaultReservoirSize, wantInterval: true},
+		{name: "runs larger than the reservoir", size: 3 * defaultReservoirSize, wantInterval: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Two runs of uniform latencies, the candidate 1 ms slower.
+			random := rand.New(rand.NewSource(1))
+			baseline, candidate := newReservoir(defaultReservoirSize), newReservoir(defaultReservoirSize)
+			for i := 0; i < test.size; i++ {
+				baseline.add(10 + random.Float64())
+				candidate.add(11 + random.Float64())
+			}
+
+			intervals := bootstrapDeltaIntervals(baseline, candidate, []float64{0.5}, 0.95, 200)
+
+			// Only runs held entirely by their reservoirs get an interval, and it covers the shift.
+			interval := intervals[0]
+			if !test.wantInterval {
+				if interval != nil {
+					t.Errorf("expected no interval, got [%g, %g]", interval.Lower, interval.Upper)
+				}
+				return
+			}
+			if interval == nil {
+				t.Fatal("expected an interval")
+			}
+			if interval.Lower > 1 || interval.Upper < 1 {
+				t.Errorf("expected an interval around 1 ms, got [%g, %g]", interval.Lower, interval.Upper)
+			}
+		})
+	}
+}
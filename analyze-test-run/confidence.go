@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// intervalOrderStatistic takes the bounds of a percentile from the aggregator, at the ranks
+	// that bound the rank of the percentile with the requested confidence. It needs no sample.
+	intervalOrderStatistic = "order_statistic"
+	// intervalBootstrap resamples a reservoir sample of the latencies, and takes the bounds from the
+	// distribution of the percentile over the resamples. It is only used while the reservoir holds
+	// every latency of the distribution: resamples of a reservoir of a larger run would give the
+	// spread of the reservoir rather than of the run, so its intervals fall back to
+	// intervalOrderStatistic. Runs larger than defaultReservoirSize need a larger ReservoirSize.
+	intervalBootstrap = "bootstrap"
+)
+
+const (
+	// defaultReservoirSize is the number of latencies kept per distribution for bootstrap resampling,
+	// enough for a run of the default 10,000 messages with its warm-up and redeliveries.
+	defaultReservoirSize = 20000
+	// maxReservoirSize bounds ReservoirSize. A run keeps three reservoirs, of 8 bytes per latency,
+	// and every resample of one is sorted.
+	maxReservoirSize = 200000
+)
+
+// minTailSamples is the number of observations that must lie beyond a percentile, on its side of the
+// median, for it to be trusted. p99.99 of 10,000 latencies rests on a single observation.
+const minTailSamples = 10
+
+// ConfidenceInterval bounds a percentile, in milliseconds, with the given confidence level. Method
+// is how it was computed, intervalOrderStatistic or intervalBootstrap.
+type ConfidenceInterval struct {
+	Lower  float64 `json:"lower"`
+	Upper  float64 `json:"upper"`
+	Level  float64 `json:"level"`
+	Method string  `json:"method"`
+}
+
+// reservoir keeps a uniform random sample of up to Size of the values added to it, see Vitter's
+// algorithm R. It draws from its own seeded source, which is checkpointed with it, so that the same
+// deliveries always give the same sample, whether or not the analysis was resumed.
+type reservoir struct {
+	Values []float64   `json:"values"`
+	Seen   uint64      `json:"seen"`
+	Size   int         `json:"size"`
+	Source *splitMix64 `json:"source"`
+	random *rand.Rand
+}
+
+func newReservoir(size int) *reservoir {
+	return &reservoir{Size: size, Source: &splitMix64{State: 1}}
+}
+
+// add adds a value to the reservoir. It does nothing to a nil reservoir, so that runs without
+// bootstrap intervals need not keep a sample.
+func (r *reservoir) add(value float64) {
+	if r == nil {
+		return
+	}
+	r.Seen++
+	if len(r.Values) < r.Size {
+		r.Values = append(r.Values, value)
+		return
+	}
+	if r.random == nil {
+		r.random = rand.New(r.Source)
+	}
+	if i := r.random.Int63n(int64(r.Seen)); i < int64(r.Size) {
+		r.Values[i] = value
+	}
+}
+
+// splitMix64 is a rand.Source whose whole state is a single exported field, so that it can be
+// serialized and resumed where it left off. See Steele, Lea and Flood, "Fast splittable
+// pseudorandom number generators".
+type splitMix64 struct {
+	State uint64 `json:"state"`
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.State += 0x9e3779b97f4a7c15
+	z := s.State
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.State = uint64(seed)
+}
+
+// complete reports whether the reservoir holds every value added to it.
+func (r *reservoir) complete() bool {
+	return r.Seen <= uint64(len(r.Values))
+}
+
+// tailSamples is the number of observations beyond a quantile, on its side of the median.
+func tailSamples(count uint64, quantile float64) float64 {
+	return float64(count) * math.Min(quantile, 1-quantile)
+}
+
+// normalQuantile is the two-sided critical value of the standard normal distribution for a
+// confidence level, e.g. 1.96 for 0.95.
+func normalQuantile(level float64) float64 {
+	return math.Sqrt2 * math.Erfinv(level)
+}
+
+// orderStatisticInterval bounds a quantile by the order statistics whose ranks bound the rank of
+// the quantile, using the normal approximation of the binomial distribution of that rank.
+func orderStatisticInterval(a aggregator, quantile float64, level float64) *ConfidenceInterval {
+	n := float64(a.Count())
+	spread := normalQuantile(level) * math.Sqrt(n*quantile*(1-quantile))
+	lower := math.Max(math.Floor(n*quantile-spread), 0)
+	upper := math.Min(math.Ceil(n*quantile+spread), n)
+	return &ConfidenceInterval{
+		Lower:  a.Quantile(lower / n),
+		Upper:  a.Quantile(upper / n),
+		Level:  level,
+		Method: intervalOrderStatistic,
+	}
+}
+
+// bootstrapIntervals bounds each quantile by the percentile bootstrap over resamples of the sample.
+// The resamples are drawn from a fixed seed, so that the same sample always gives the same intervals.
+func bootstrapIntervals(sample []float64, quantiles []float64, level float64, resamples int) []*ConfidenceInterval {
+	random := rand.New(rand.NewSource(1))
+	estimates := make([][]float64, len(quantiles))
+	resample := make([]float64, len(sample))
+	for i := 0; i < resamples; i++ {
+		for k, estimate := range resampleQuantiles(random, sample, resample, quantiles) {
+			estimates[k] = append(estimates[k], estimate)
+		}
+	}
+	return percentileIntervals(estimates, level)
+}
+
+// resampleQuantiles draws a resample of the sample with replacement into resample, and returns its
+// quantiles.
+func resampleQuantiles(random *rand.Rand, sample []float64, resample []float64, quantiles []float64) []float64 {
+	for j := range resample {
+		resample[j] = sample[random.Intn(len(sample))]
+	}
+	sort.Float64s(resample)
+	estimates := make([]float64, len(quantiles))
+	for k, quantile := range quantiles {
+		estimates[k] = sortedQuantile(resample, quantile)
+	}
+	return estimates
+}
+
+// percentileIntervals bounds each statistic by the percentiles of its bootstrap estimates.
+func percentileIntervals(estimates [][]float64, level float64) []*ConfidenceInterval {
+	intervals := make([]*ConfidenceInterval, len(estimates))
+	for k := range estimates {
+		sort.Float64s(estimates[k])
+		intervals[k] = &ConfidenceInterval{
+			Lower:  sortedQuantile(estimates[k], (1-level)/2),
+			Upper:  sortedQuantile(estimates[k], (1+level)/2),
+			Level:  level,
+			Method: intervalBootstrap,
+		}
+	}
+	return intervals
+}
+
+// sortedQuantile interpolates a quantile of sorted values linearly between the closest ranks, the
+// same way as exactAggregator.
+func sortedQuantile(sorted []float64, quantile float64) float64 {
+	rank := quantile * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// addIntervals sets the confidence interval of every percentile of a summary and flags the ones with
+// too few observations in their tail. The minimum and maximum have no interval. The sample is only
+// used by the bootstrap method, and only while it holds every latency of the distribution.
+func (request AnalyzeRequest) addIntervals(summary *LatencySummary, a aggregator, sample *reservoir) {
+	flagInsufficient(summary)
+	if summary.Count == 0 {
+		return
+	}
+	var bootstrapped []*ConfidenceInterval
+	if request.Interval == intervalBootstrap && sample != nil && len(sample.Values) > 0 && sample.complete() {
+		bootstrapped = bootstrapIntervals(sample.Values, request.Quantiles, request.ConfidenceLevel, request.Resamples)
+	}
+	for i := range summary.Percentiles {
+		percentile := &summary.Percentiles[i]
+		if percentile.Quantile == 0 || percentile.Quantile == 1 {
+			continue
+		}
+		if bootstrapped != nil {
+			percentile.Interval = bootstrapped[i]
+		} else {
+			percentile.Interval = orderStatisticInterval(a, percentile.Quantile, request.ConfidenceLevel)
+		}
+	}
+}
+
+// flagInsufficient flags the percentiles of a summary with too few observations in their tail. The
+// minimum and maximum are exact, so they are never flagged.
+func flagInsufficient(summary *LatencySummary) {
+	for i := range summary.Percentiles {
+		percentile := &summary.Percentiles[i]
+		if percentile.Quantile == 0 || percentile.Quantile == 1 {
+			continue
+		}
+		percentile.Insufficient = tailSamples(summary.Count, percentile.Quantile) < minTailSamples
+	}
+}
+
+// formatPercentile formats the value of a percentile with its interval, and marks it with an
+// asterisk if it has too few observations in its tail to be trusted.
+func formatPercentile(percentile Percentile) string {
+	formatted := fmt.Sprintf("%.3f", percentile.Value)
+	if percentile.Interval != nil {
+		formatted += fmt.Sprintf(" [%.3f, %.3f]", percentile.Interval.Lower, percentile.Interval.Upper)
+	}
+	if percentile.Insufficient {
+		formatted += "*"
+	}
+	return formatted
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestOrderStatisticIntervalCoverage(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantile float64
+	}{
+		{name: "median", quantile: 0.5},
+		{name: "p90", quantile: 0.9},
+		{name: "p99", quantile: 0.99},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 400 samples of 2000 latencies uniform on [0, 1), whose quantile q is q.
+			random := rand.New(rand.NewSource(1))
+			const samples, size, level = 400, 2000, 0.95
+
+			covered := 0
+			for i := 0; i < samples; i++ {
+				a := newAggregator(aggregatorExact, 0, 0)
+				for j := 0; j < size; j++ {
+					a.Add(random.Float64())
+				}
+				interval := orderStatisticInterval(a, test.quantile, level)
+				if interval.Lower <= test.quantile && test.quantile <= interval.Upper {
+					covered++
+				}
+			}
+
+			// About 95% of the 95% intervals hold the quantile.
+			if coverage := float64(covered) / samples; coverage < 0.92 || coverage > 0.99 {
+				t.Errorf("expected a coverage of about %.2f, got %.3f", level, coverage)
+			}
+		})
+	}
+}
+
+func TestBootstrapIntervalsNeedTheWholeRun(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want string
+	}{
+		{name: "run within the reservoir", size: 1000, want: intervalBootstrap},
+		{name: "run larger than the reservoir", size: 2000, want: intervalOrderStatistic},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter, Interval: intervalBootstrap, Resamples: 100, ReservoirSize: 1000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			random := rand.New(rand.NewSource(1))
+			a := newAggregator(aggregatorExact, 0, 0)
+			sample := newReservoir(request.ReservoirSize)
+			for i := 0; i < test.size; i++ {
+				value := random.Float64()
+				a.Add(value)
+				sample.add(value)
+			}
+
+			summary := request.summarize(a, sample)
+
+			// The bootstrap is only used when the reservoir holds the whole run.
+			for _, percentile := range summary.Percentiles {
+				if percentile.Interval != nil && percentile.Interval.Method != test.want {
+					t.Errorf("expected %s intervals, got %+v for p%g", test.want, *percentile.Interval, percentile.Quantile*100)
+				}
+			}
+		})
+	}
+}
+
+func TestReservoirResumesWithTheSameSample(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	values := make([]float64, 5000)
+	for i := range values {
+		values[i] = random.Float64()
+	}
+	whole := newReservoir(1000)
+	for _, value := range values {
+		whole.add(value)
+	}
+
+	// Checkpoint the reservoir halfway through and resume from its serialized form.
+	resumed := newReservoir(1000)
+	for _, value := range values[:2500] {
+		resumed.add(value)
+	}
+	serialized, err := json.Marshal(resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed = nil
+	if err := json.Unmarshal(serialized, &resumed); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range values[2500:] {
+		resumed.add(value)
+	}
+
+	if !reflect.DeepEqual(resumed.Values, whole.Values) || resumed.Seen != whole.Seen {
+		t.Errorf("expected the resumed reservoir to hold the same sample as the uninterrupted one")
+	}
+}
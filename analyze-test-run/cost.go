@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+const (
+	serviceSqs     = "sqs"
+	serviceSqsFifo = "sqs-fifo"
+	serviceKinesis = "kinesis"
+)
+
+const (
+	// producerBatchSize is the number of messages the producers send per SendMessageBatch or
+	// PutRecords request.
+	producerBatchSize = 10
+	// sqsChunkBytes is the payload size billed as one SQS request.
+	sqsChunkBytes = 64 * 1024
+	// kinesisPayloadUnitBytes is the record size billed as one Kinesis PUT payload unit.
+	kinesisPayloadUnitBytes = 25 * 1024
+	bytesPerGB              = 1 << 30
+)
+
+// Prices are the prices in USD of the services a transport is billed for, in one region.
+type Prices struct {
+	SqsStandardPerMillionRequests float64 `json:"sqs_standard_per_million_requests"`
+	SqsFifoPerMillionRequests     float64 `json:"sqs_fifo_per_million_requests"`
+	KinesisShardHour              float64 `json:"kinesis_shard_hour"`
+	KinesisPerMillionPayloadUnits float64 `json:"kinesis_per_million_payload_units"`
+	KinesisEfoConsumerShardHour   float64 `json:"kinesis_efo_consumer_shard_hour"`
+	KinesisEfoPerGB               float64 `json:"kinesis_efo_per_gb"`
+	LambdaPerMillionRequests      float64 `json:"lambda_per_million_requests"`
+	LambdaX86GBSecond             float64 `json:"lambda_x86_gb_second"`
+	LambdaArmGBSecond             float64 `json:"lambda_arm_gb_second"`
+}
+
+// defaultPriceTable holds the on-demand prices of the regions the benchmark is usually deployed to,
+// without free tiers. Other regions are configured with PRICE_TABLE, see loadPriceTable.
+var defaultPriceTable = map[string]Prices{
+	"us-east-1": usEastPrices,
+	"us-west-2": usWestPrices,
+}
+
+// usEastPrices are the prices of US East (N. Virginia).
+var usEastPrices = Prices{
+	SqsStandardPerMillionRequests: 0.40,
+	SqsFifoPerMillionRequests:     0.50,
+	KinesisShardHour:              0.015,
+	KinesisPerMillionPayloadUnits: 0.014,
+	KinesisEfoConsumerShardHour:   0.015,
+	KinesisEfoPerGB:               0.013,
+	LambdaPerMillionRequests:      0.20,
+	LambdaX86GBSecond:             0.0000166667,
+	LambdaArmGBSecond:             0.0000133334,
+}
+
+// usWestPrices are the prices of US West (Oregon), which are listed at the same rates as those of
+// US East (N. Virginia) for every service a transport is billed for.
+var usWestPrices = Prices{
+	SqsStandardPerMillionRequests: 0.40,
+	SqsFifoPerMillionRequests:     0.50,
+	KinesisShardHour:              0.015,
+	KinesisPerMillionPayloadUnits: 0.014,
+	KinesisEfoConsumerShardHour:   0.015,
+	KinesisEfoPerGB:               0.013,
+	LambdaPerMillionRequests:      0.20,
+	LambdaX86GBSecond:             0.0000166667,
+	LambdaArmGBSecond:             0.0000133334,
+}
+
+// priceTable holds the prices by region, the defaults overridden by PRICE_TABLE.
+var priceTable = defaultPriceTable
+
+// streamShardCount is the number of shards of the stream, from STREAM_SHARD_COUNT. Every shard is
+// billed, whether or not it delivered messages of a run. 0 when unknown.
+var streamShardCount int
+
+// loadPriceTable reads a price table as JSON keyed by region, e.g. {"eu-west-1": {...}}. A region
+// it lists replaces the default prices of that region as a whole.
+func loadPriceTable(value string) (map[string]Prices, error) {
+	var configured map[string]Prices
+	if err := json.Unmarshal([]byte(value), &configured); err != nil {
+		return nil, fmt.Errorf("failed to parse price table, %w", err)
+	}
+	table := make(map[string]Prices)
+	for priceRegion, prices := range defaultPriceTable {
+		table[priceRegion] = prices
+	}
+	for priceRegion, prices := range configured {
+		table[priceRegion] = prices
+	}
+	return table, nil
+}
+
+// CostResult is the estimated cost of a run in USD, itemized, and per million delivered messages.
+// Missing lists the inputs that could not be measured, whose cost is left out of the estimate.
+type CostResult struct {
+	Region             string     `json:"region"`
+	Service            string     `json:"service"`
+	Items              []CostItem `json:"items"`
+	Total              float64    `json:"total"`
+	PerMillionMessages float64    `json:"per_million_messages"`
+	Missing            []string   `json:"missing,omitempty"`
+}
+
+// CostItem is the cost of one billed quantity, e.g. Lambda GB-seconds.
+type CostItem struct {
+	Item      string  `json:"item"`
+	Quantity  float64 `json:"quantity"`
+	Unit      string  `json:"unit"`
+	UnitPrice float64 `json:"unit_price"`
+	Cost      float64 `json:"cost"`
+}
+
+// usage accumulates what a run is billed by that can be told from its deliveries.
+type usage struct {
+	service         string
+	architecture    string
+	payloadBytes    uint64
+	putPayloadUnits uint64
+	shards          map[string]bool
+}
+
+// usageState is the serialized form of usage.
+type usageState struct {
+	Service         string   `json:"service"`
+	Architecture    string   `json:"architecture"`
+	PayloadBytes    uint64   `json:"payload_bytes"`
+	PutPayloadUnits uint64   `json:"put_payload_units"`
+	Shards          []string `json:"shards"`
+}
+
+func newUsage() *usage {
+	return &usage{shards: make(map[string]bool)}
+}
+
+// add accounts for a delivery. Deliveries from a shard are from Kinesis, deliveries with a message
+// group ID from a FIFO queue.
+func (u *usage) add(output Output) {
+	switch {
+	case output.ShardId != "":
+		u.service = serviceKinesis
+		u.shards[output.ShardId] = true
+	case u.service == "" && output.PartitionKey != "":
+		u.service = serviceSqsFifo
+	case u.service == "":
+		u.service = serviceSqs
+	}
+	if output.Architecture != "" {
+		u.architecture = output.Architecture
+	}
+	size := uint64(len(output.Body))
+	u.payloadBytes += size
+	u.putPayloadUnits += uint64(math.Max(1, math.Ceil(float64(size)/kinesisPayloadUnitBytes)))
+}
+
+func (u *usage) result() *UsageResult {
+	if u.service == "" {
+		return nil
+	}
+	return &UsageResult{
+		Service:         u.service,
+		Architecture:    u.architecture,
+		PayloadBytes:    u.payloadBytes,
+		PutPayloadUnits: u.putPayloadUnits,
+		Shards:          len(u.shards),
+	}
+}
+
+func (u *usage) state() usageState {
+	state := usageState{
+		Service:         u.service,
+		Architecture:    u.architecture,
+		PayloadBytes:    u.payloadBytes,
+		PutPayloadUnits: u.putPayloadUnits,
+	}
+	for shard := range u.shards {
+		state.Shards = append(state.Shards, shard)
+	}
+	return state
+}
+
+func (u *usage) restore(state usageState) {
+	u.service = state.Service
+	u.architecture = state.Architecture
+	u.payloadBytes = state.PayloadBytes
+	u.putPayloadUnits = state.PutPayloadUnits
+	for _, shard := range state.Shards {
+		u.shards[shard] = true
+	}
+}
+
+// UsageResult is what a run is billed by, as far as it can be told from its deliveries. Shards only
+// counts the shards that delivered messages of the run.
+type UsageResult struct {
+	Service         string `json:"service"`
+	Architecture    string `json:"architecture,omitempty"`
+	PayloadBytes    uint64 `json:"payload_bytes"`
+	PutPayloadUnits uint64 `json:"put_payload_units"`
+	Shards          int    `json:"shards,omitempty"`
+}
+
+// estimateCost estimates the cost of a run from its usage, which is only known from FilterLogEvents,
+// the REPORT lines of its invocations and the prices of the region. Without REPORT lines, the
+// invocations are estimated from the largest batch size and the Lambda duration is missing.
+// Shard-hours are prorated to the duration of the run, for every shard of the stream, or only for
+// the shards that delivered when streamShardCount is unknown. The stream consumer reads with
+// enhanced fan-out; SQS empty receives are not counted.
+func estimateCost(run RunResult, priceRegion string) *CostResult {
+	prices, ok := priceTable[priceRegion]
+	if !ok || run.Usage == nil || run.All.Count == 0 {
+		return nil
+	}
+	result := &CostResult{Region: priceRegion, Service: run.Usage.Service}
+	addItem := func(item string, quantity float64, unit string, unitPrice float64) {
+		cost := CostItem{Item: item, Quantity: quantity, Unit: unit, UnitPrice: unitPrice, Cost: quantity * unitPrice}
+		result.Items = append(result.Items, cost)
+		result.Total += cost.Cost
+	}
+	messages := float64(run.All.Count)
+
+	invocations := messages
+	if run.Invocations != nil {
+		invocations = float64(run.Invocations.Count)
+	} else {
+		if run.MaxBatchSize > 0 {
+			invocations = math.Ceil(messages / float64(run.MaxBatchSize))
+		}
+		result.Missing = append(result.Missing, "lambda duration, no REPORT lines were joined to the run")
+	}
+	addItem("lambda requests", invocations/1e6, "million requests", prices.LambdaPerMillionRequests)
+	if run.Invocations != nil {
+		gbSeconds := run.Invocations.TotalBilledDurationMs / 1000 * float64(run.Invocations.MemorySizeMb) / 1024
+		gbSecondPrice := prices.LambdaX86GBSecond
+		if run.Usage.Architecture == "arm64" {
+			gbSecondPrice = prices.LambdaArmGBSecond
+		}
+		addItem("lambda duration", gbSeconds, "GB-seconds", gbSecondPrice)
+	}
+
+	switch run.Usage.Service {
+	case serviceSqs, serviceSqsFifo:
+		// Every batch is sent, received and deleted with a request per 64 KiB of payload.
+		sends := math.Max(math.Ceil(messages/producerBatchSize), math.Ceil(float64(run.Usage.PayloadBytes)/sqsChunkBytes))
+		requests := sends + 2*invocations
+		price := prices.SqsStandardPerMillionRequests
+		if run.Usage.Service == serviceSqsFifo {
+			price = prices.SqsFifoPerMillionRequests
+		}
+		addItem("sqs requests", requests/1e6, "million requests", price)
+	case serviceKinesis:
+		hours := run.DurationSeconds / 3600
+		if run.DurationSeconds == 0 {
+			result.Missing = append(result.Missing, "run duration, for shard-hours")
+		}
+		shards := math.Max(float64(run.Usage.Shards), float64(streamShardCount))
+		if streamShardCount == 0 {
+			result.Missing = append(result.Missing, "shards that delivered no messages, STREAM_SHARD_COUNT is not set, shard-hours are a lower bound")
+		}
+		addItem("kinesis shard-hours", shards*hours, "shard-hours", prices.KinesisShardHour)
+		addItem("kinesis put payload units", float64(run.Usage.PutPayloadUnits)/1e6, "million units", prices.KinesisPerMillionPayloadUnits)
+		addItem("kinesis efo consumer-shard-hours", shards*hours, "consumer-shard-hours", prices.KinesisEfoConsumerShardHour)
+		addItem("kinesis efo data retrieval", float64(run.Usage.PayloadBytes)/bytesPerGB, "GB", prices.KinesisEfoPerGB)
+	}
+	result.PerMillionMessages = result.Total / messages * 1e6
+	return result
+}
+
+func printCost(testRunId string, cost *CostResult) {
+	for _, item := range cost.Items {
+		fmt.Printf("testRunId %s, cost of %s: %.6g %s at $%.6g = $%.6f\n",
+			testRunId, item.Item, item.Quantity, item.Unit, item.UnitPrice, item.Cost)
+	}
+	fmt.Printf("testRunId %s, estimated cost on %s in %s = $%.6f, $%.4f per million messages\n",
+		testRunId, cost.Service, cost.Region, cost.Total, cost.PerMillionMessages)
+	for _, missing := range cost.Missing {
+		fmt.Printf("testRunId %s, cost leaves out %s\n", testRunId, missing)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimateCost(t *testing.T) {
+	// A run of 1000 messages of 100 bytes on a standard queue, handled by 100 invocations of a
+	// 1 GiB x86 function billed for 100 s in total.
+	run := RunResult{
+		All:         LatencySummary{Count: 1000},
+		Invocations: &InvocationsResult{Count: 100, MemorySizeMb: 1024, TotalBilledDurationMs: 100000},
+		Usage:       &UsageResult{Service: serviceSqs, Architecture: "x86_64", PayloadBytes: 100000},
+	}
+
+	cost := estimateCost(run, "us-east-1")
+
+	// 100 Lambda requests, 100 GB-seconds and 100 batches sent, received and deleted.
+	want := map[string]float64{
+		"lambda requests": 100 / 1e6 * 0.20,
+		"lambda duration": 100 * 0.0000166667,
+		"sqs requests":    300 / 1e6 * 0.40,
+	}
+	if cost == nil || len(cost.Items) != len(want) {
+		t.Fatalf("expected %d cost items, got %+v", len(want), cost)
+	}
+	var total float64
+	for _, item := range cost.Items {
+		if math.Abs(item.Cost-want[item.Item]) > 1e-12 {
+			t.Errorf("expected %s to cost %g, got %g", item.Item, want[item.Item], item.Cost)
+		}
+		total += want[item.Item]
+	}
+	if math.Abs(cost.Total-total) > 1e-12 || math.Abs(cost.PerMillionMessages-total*1000) > 1e-9 {
+		t.Errorf("expected a total of %g, %g per million messages, got %+v", total, total*1000, *cost)
+	}
+	if len(cost.Missing) != 0 {
+		t.Errorf("expected nothing missing, got %v", cost.Missing)
+	}
+}
+
+func TestEstimateCostWithoutPrices(t *testing.T) {
+	defer func(previous string) { region = previous }(region)
+	region = "ap-southeast-7"
+	request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := newRunAggregate(request)
+
+	for i := 0; i < 10; i++ {
+		run.add(Output{MessageNumber: i, TimeDiffNs: int(10 * time.Millisecond), Body: "message"})
+	}
+	result := run.result("run")
+
+	// The usage is known but the cost is not estimated.
+	if result.Usage == nil || result.Usage.Service != serviceSqs || result.Usage.PayloadBytes != 70 {
+		t.Errorf("expected the usage of a standard queue, got %+v", result.Usage)
+	}
+	if result.Cost != nil {
+		t.Errorf("expected no cost, got %+v", *result.Cost)
+	}
+}
+
+func TestEstimateCostShardHours(t *testing.T) {
+	tests := []struct {
+		name       string
+		shardCount int
+		shards     float64
+		lowerBound bool
+	}{
+		{name: "shard count configured", shardCount: 10, shards: 10},
+		{name: "shard count unknown", shardCount: 0, shards: 2, lowerBound: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A run of an hour on a stream, delivered by 2 of its shards.
+			defer func(previous int) { streamShardCount = previous }(streamShardCount)
+			streamShardCount = test.shardCount
+			run := RunResult{
+				All:             LatencySummary{Count: 1000},
+				DurationSeconds: 3600,
+				Invocations:     &InvocationsResult{Count: 100, MemorySizeMb: 1024, TotalBilledDurationMs: 100000},
+				Usage:           &UsageResult{Service: serviceKinesis, Architecture: "arm64", PayloadBytes: 100000, PutPayloadUnits: 1000, Shards: 2},
+			}
+
+			cost := estimateCost(run, "us-east-1")
+
+			// Every shard of the stream is billed, or the shard-hours are flagged as a lower bound.
+			for _, item := range cost.Items {
+				if strings.HasSuffix(item.Item, "shard-hours") && item.Quantity != test.shards {
+					t.Errorf("expected %g %s, got %g", test.shards, item.Item, item.Quantity)
+				}
+			}
+			if got := len(cost.Missing) == 1; got != test.lowerBound {
+				t.Errorf("expected shard-hours flagged as a lower bound = %v, got missing %v", test.lowerBound, cost.Missing)
+			}
+		})
+	}
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	table, err := loadPriceTable(`{"us-east-1": {"lambda_per_million_requests": 0.25}, "eu-west-1": {"lambda_per_million_requests": 0.2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		region string
+		want   Prices
+	}{
+		{region: "us-east-1", want: Prices{LambdaPerMillionRequests: 0.25}},
+		{region: "us-west-2", want: usWestPrices},
+		{region: "eu-west-1", want: Prices{LambdaPerMillionRequests: 0.2}},
+	}
+	for _, test := range tests {
+		t.Run(test.region, func(t *testing.T) {
+			if got := table[test.region]; got != test.want {
+				t.Errorf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
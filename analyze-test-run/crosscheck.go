@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// crossCheckLimit is the largest number of latencies that are cross-checked, because the exact
+// aggregator keeps every one of them in memory.
+const crossCheckLimit = 100000
+
+// crossCheck feeds the latencies of a run to every kind of aggregator, so that the t-digest and
+// HDR histogram quantiles can be compared to the exact quantiles.
+type crossCheck struct {
+	exact    aggregator
+	digest   aggregator
+	hdr      aggregator
+	exceeded bool
+}
+
+// CrossCheckResult compares the quantiles of each aggregator against the exact quantiles.
+type CrossCheckResult struct {
+	Count     uint64               `json:"count"`
+	Skipped   string               `json:"skipped,omitempty"`
+	Quantiles []CrossCheckQuantile `json:"quantiles,omitempty"`
+}
+
+// CrossCheckQuantile holds the value of one quantile from each aggregator, in milliseconds, and the
+// relative error of the approximate ones.
+type CrossCheckQuantile struct {
+	Quantile     float64 `json:"quantile"`
+	Exact        float64 `json:"exact"`
+	TDigest      float64 `json:"tdigest"`
+	Hdr          float64 `json:"hdr"`
+	TDigestError float64 `json:"tdigest_error"`
+	HdrError     float64 `json:"hdr_error"`
+}
+
+func newCrossCheck(significantFigures int) *crossCheck {
+	return &crossCheck{
+		exact:  newAggregator(aggregatorExact, 0, 0),
+		digest: newAggregator(aggregatorTDigest, 10000, 0),
+		hdr:    newAggregator(aggregatorHdr, 0, significantFigures),
+	}
+}
+
+func (c *crossCheck) add(latency float64) {
+	if c.exceeded {
+		return
+	}
+	if c.exact.Count() >= crossCheckLimit {
+		// Stop before the exact aggregator uses too much memory, the comparison is meaningless for
+		// a partial run anyway.
+		c.exceeded = true
+		c.exact, c.digest, c.hdr = nil, nil, nil
+		return
+	}
+	c.exact.Add(latency)
+	c.digest.Add(latency)
+	c.hdr.Add(latency)
+}
+
+func relativeError(value float64, exact float64) float64 {
+	if exact == 0 {
+		return math.Abs(value)
+	}
+	return math.Abs(value-exact) / math.Abs(exact)
+}
+
+func (c *crossCheck) result(quantiles []float64) *CrossCheckResult {
+	if c.exceeded {
+		return &CrossCheckResult{Skipped: fmt.Sprintf("run has more than %d deliveries", crossCheckLimit)}
+	}
+	result := &CrossCheckResult{Count: c.exact.Count()}
+	if c.exact.Count() == 0 {
+		return result
+	}
+	for _, quantile := range quantiles {
+		exact := c.exact.Quantile(quantile)
+		digest := c.digest.Quantile(quantile)
+		hdr := c.hdr.Quantile(quantile)
+		result.Quantiles = append(result.Quantiles, CrossCheckQuantile{
+			Quantile:     quantile,
+			Exact:        exact,
+			TDigest:      digest,
+			Hdr:          hdr,
+			TDigestError: relativeError(digest, exact),
+			HdrError:     relativeError(hdr, exact),
+		})
+	}
+	return result
+}
+
+func printCrossCheck(testRunId string, result *CrossCheckResult) {
+	if result.Skipped != "" {
+		fmt.Printf("testRunId %s, cross check skipped: %s\n", testRunId, result.Skipped)
+		return
+	}
+	for _, q := range result.Quantiles {
+		fmt.Printf("testRunId %s, cross check %s: exact = %.3f, tdigest = %.3f (error %.2f%%), hdr = %.3f (error %.2f%%)\n",
+			testRunId, percentileName(q.Quantile), q.Exact, q.TDigest, q.TDigestError*100, q.Hdr, q.HdrError*100)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cloudformationtypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// consumerFunctionPattern matches the logical IDs CDK generates for consumer functions, e.g.
+// "QueueConsumerFunction1A2B3C4D" for the construct "QueueConsumerFunction". The prefix names the
+// transport path that the function consumes.
+var consumerFunctionPattern = regexp.MustCompile(`^([A-Za-z0-9]+?)ConsumerFunction[0-9A-F]{8}$`)
+
+var upperCasePattern = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+// transportLabel turns the construct name prefix of a consumer function into a transport label,
+// e.g. "Queue" into "queue" and "FifoQueue" into "fifo-queue".
+func transportLabel(prefix string) string {
+	return strings.ToLower(upperCasePattern.ReplaceAllString(prefix, "$1-$2"))
+}
+
+// discoverLogGroups finds every consumer function in the stack and returns the log group of each,
+// keyed by transport label.
+func discoverLogGroups(ctx context.Context, stackName string) (map[string]string, error) {
+	resources, err := cloudformationClient.DescribeStackResources(ctx, &cloudformation.DescribeStackResourcesInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe resources of stack %s, %w", stackName, err)
+	}
+	return consumerLogGroups(resources.StackResources), nil
+}
+
+// consumerLogGroups returns the log group of every consumer function among the resources of a
+// stack, keyed by transport label.
+func consumerLogGroups(resources []cloudformationtypes.StackResource) map[string]string {
+	discovered := make(map[string]string)
+	for _, resource := range resources {
+		if aws.ToString(resource.ResourceType) != "AWS::Lambda::Function" {
+			continue
+		}
+		match := consumerFunctionPattern.FindStringSubmatch(aws.ToString(resource.LogicalResourceId))
+		if match == nil {
+			continue
+		}
+		discovered[transportLabel(match[1])] = "/aws/lambda/" + aws.ToString(resource.PhysicalResourceId)
+	}
+	return discovered
+}
+
+// loadLogGroups adds the consumer log groups discovered from the stack to logGroupNames, the first
+// time it succeeds in an execution environment. Until then the log groups from the env vars are used.
+func loadLogGroups(ctx context.Context) {
+	if stackName == "" || logGroupsDiscovered {
+		return
+	}
+	discovered, err := discoverLogGroups(ctx, stackName)
+	if err != nil {
+		fmt.Printf("could not discover log groups, using configured log groups: %+v\n", err)
+		return
+	}
+	for transport, logGroupName := range discovered {
+		fmt.Printf("discovered transport %s with log group %s\n", transport, logGroupName)
+		logGroupNames[transport] = logGroupName
+	}
+	logGroupsDiscovered = true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cloudformationtypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+func TestTransportLabel(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "Queue", want: "queue"},
+		{prefix: "Stream", want: "stream"},
+		{prefix: "FifoQueue", want: "fifo-queue"},
+		{prefix: "Sns2Queue", want: "sns2-queue"},
+	}
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			if got := transportLabel(test.prefix); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func stackResource(resourceType string, logicalId string, physicalId string) cloudformationtypes.StackResource {
+	return cloudformationtypes.StackResource{
+		ResourceType:       aws.String(resourceType),
+		LogicalResourceId:  aws.String(logicalId),
+		PhysicalResourceId: aws.String(physicalId),
+	}
+}
+
+func TestConsumerLogGroups(t *testing.T) {
+	// The logical IDs of the functions are the ones CDK synthesizes for the stack in infra.
+	resources := []cloudformationtypes.StackResource{
+		stackResource("AWS::Lambda::Function", "QueueConsumerFunctionB25E1C91", "EventBenchmark-QueueConsumerFunctionB25E1C91-AbC123"),
+		stackResource("AWS::Lambda::Function", "StreamConsumerFunction1AE744CB", "EventBenchmark-StreamConsumerFunction1AE744CB-dEf456"),
+		stackResource("AWS::Lambda::Function", "FifoQueueConsumerFunction0A1B2C3D", "EventBenchmark-FifoQueueConsumerFunct-gHi789"),
+		stackResource("AWS::Lambda::Function", "QueueProducerFunction1D78C760", "EventBenchmark-QueueProducerFunction1D78C760-jKl012"),
+		stackResource("AWS::Lambda::Function", "AnalyzeTestRunFunctionC32529C3", "EventBenchmark-AnalyzeTestRunFunctionC32529C3-mNo345"),
+		stackResource("AWS::Lambda::Function", "LogRetentionaae0aa3c5b4d4f87b02d85b201efdd8aFD4BFC8A", "EventBenchmark-LogRetentionaae0aa3c5b4d4f87b02d8-pQr678"),
+		stackResource("AWS::IAM::Role", "QueueConsumerFunctionServiceRole6A1B8E44", "EventBenchmark-QueueConsumerFunctionServiceRole-sTu901"),
+		stackResource("AWS::Lambda::EventSourceMapping", "QueueConsumerFunctionSqsEventSourceEventBenchmarkQueue4D7C1F2A", "a1b2c3d4"),
+	}
+	want := map[string]string{
+		"queue":      "/aws/lambda/EventBenchmark-QueueConsumerFunctionB25E1C91-AbC123",
+		"stream":     "/aws/lambda/EventBenchmark-StreamConsumerFunction1AE744CB-dEf456",
+		"fifo-queue": "/aws/lambda/EventBenchmark-FifoQueueConsumerFunct-gHi789",
+	}
+	if got := consumerLogGroups(resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
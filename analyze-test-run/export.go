@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	exportCSV     = "csv"
+	exportJSONL   = "jsonl"
+	exportParquet = "parquet"
+)
+
+// exportPartSize is the number of records buffered before they are written out as a part, which
+// bounds the memory used by exports and the records lost if an invocation fails. Records take a few
+// hundred bytes each, and about as much again once encoded, so a part stays within a few MB of the
+// 128 MB the analyzer runs with.
+const exportPartSize = 5000
+
+// ExportRecord is a single delivery logged by a consumer. The schema is the same in every format;
+// the date, scenario and transport are partition columns taken from the path, not the file.
+type ExportRecord struct {
+	TestRunId               string  `json:"test_run_id" parquet:"name=test_run_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MessageNumber           int64   `json:"message_number" parquet:"name=message_number, type=INT64"`
+	TimeSentUs              int64   `json:"time_sent_us" parquet:"name=time_sent_us, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	LatencyMs               float64 `json:"latency_ms" parquet:"name=latency_ms, type=DOUBLE"`
+	WarmUp                  bool    `json:"warm_up" parquet:"name=warm_up, type=BOOLEAN"`
+	ColdStart               bool    `json:"cold_start" parquet:"name=cold_start, type=BOOLEAN"`
+	WorkDurationMs          float64 `json:"work_duration_ms" parquet:"name=work_duration_ms, type=DOUBLE"`
+	RequestId               string  `json:"request_id" parquet:"name=request_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	EventId                 string  `json:"event_id" parquet:"name=event_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	FunctionMemorySize      int64   `json:"function_memory_size" parquet:"name=function_memory_size, type=INT64"`
+	Architecture            string  `json:"architecture" parquet:"name=architecture, type=BYTE_ARRAY, convertedtype=UTF8"`
+	HandlerStartTimeUs      int64   `json:"handler_start_time_us" parquet:"name=handler_start_time_us, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	BatchIndex              int64   `json:"batch_index" parquet:"name=batch_index, type=INT64"`
+	BatchSize               int64   `json:"batch_size" parquet:"name=batch_size, type=INT64"`
+	PartitionKey            string  `json:"partition_key" parquet:"name=partition_key, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ShardId                 string  `json:"shard_id" parquet:"name=shard_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SequenceNumber          string  `json:"sequence_number" parquet:"name=sequence_number, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ApproximateReceiveCount int64   `json:"approximate_receive_count" parquet:"name=approximate_receive_count, type=INT64"`
+}
+
+// ExportRun is the summary of one distribution of a run, e.g. its cold deliveries. Its percentiles
+// are exported separately as ExportPercentile, so that the schema does not depend on the request.
+type ExportRun struct {
+	AnalysisId      string  `json:"analysis_id" parquet:"name=analysis_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TestRunId       string  `json:"test_run_id" parquet:"name=test_run_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Backend         string  `json:"backend" parquet:"name=backend, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Aggregator      string  `json:"aggregator" parquet:"name=aggregator, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Distribution    string  `json:"distribution" parquet:"name=distribution, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Count           int64   `json:"count" parquet:"name=count, type=INT64"`
+	MeanMs          float64 `json:"mean_ms" parquet:"name=mean_ms, type=DOUBLE"`
+	StdDevMs        float64 `json:"stddev_ms" parquet:"name=stddev_ms, type=DOUBLE"`
+	TrimmedMeanMs   float64 `json:"trimmed_mean_ms" parquet:"name=trimmed_mean_ms, type=DOUBLE"`
+	ColdStarts      int64   `json:"cold_starts" parquet:"name=cold_starts, type=INT64"`
+	FirstReceivedUs int64   `json:"first_received_us" parquet:"name=first_received_us, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	LastReceivedUs  int64   `json:"last_received_us" parquet:"name=last_received_us, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	DurationSeconds float64 `json:"duration_seconds" parquet:"name=duration_seconds, type=DOUBLE"`
+	Throughput      float64 `json:"throughput" parquet:"name=throughput, type=DOUBLE"`
+}
+
+// ExportPercentile is one percentile of one distribution of a run.
+type ExportPercentile struct {
+	AnalysisId   string  `json:"analysis_id" parquet:"name=analysis_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TestRunId    string  `json:"test_run_id" parquet:"name=test_run_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Distribution string  `json:"distribution" parquet:"name=distribution, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Quantile     float64 `json:"quantile" parquet:"name=quantile, type=DOUBLE"`
+	ValueMs      float64 `json:"value_ms" parquet:"name=value_ms, type=DOUBLE"`
+	LowerMs      float64 `json:"lower_ms" parquet:"name=lower_ms, type=DOUBLE"`
+	UpperMs      float64 `json:"upper_ms" parquet:"name=upper_ms, type=DOUBLE"`
+	Insufficient bool    `json:"insufficient" parquet:"name=insufficient, type=BOOLEAN"`
+}
+
+// microseconds returns the Unix time of a timestamp in microseconds, or 0 for the zero time.
+func microseconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMicro()
+}
+
+func newExportRecord(output Output) ExportRecord {
+	datum, _ := output.datum()
+	sentAt, _ := datum.sentAt()
+	handlerStartTime, _ := time.Parse(time.RFC3339Nano, output.HandlerStartTime)
+	return ExportRecord{
+		TestRunId:               output.TestRunId,
+		MessageNumber:           int64(output.MessageNumber),
+		TimeSentUs:              microseconds(sentAt),
+		LatencyMs:               milliseconds(time.Duration(output.TimeDiffNs)),
+		WarmUp:                  datum.WarmUp,
+		ColdStart:               output.ColdStart,
+		WorkDurationMs:          milliseconds(time.Duration(output.WorkDurationNs)),
+		RequestId:               output.RequestId,
+		EventId:                 output.EventId,
+		FunctionMemorySize:      int64(output.FunctionMemorySize),
+		Architecture:            output.Architecture,
+		HandlerStartTimeUs:      microseconds(handlerStartTime),
+		BatchIndex:              int64(output.BatchIndex),
+		BatchSize:               int64(output.BatchSize),
+		PartitionKey:            output.PartitionKey,
+		ShardId:                 output.ShardId,
+		SequenceNumber:          output.SequenceNumber,
+		ApproximateReceiveCount: int64(output.ApproximateReceiveCount),
+	}
+}
+
+type namedSummary struct {
+	name    string
+	summary LatencySummary
+}
+
+// exportRuns flattens the results of a transport into ExportRun and ExportPercentile rows.
+func exportRuns(analysisId string, transport TransportResult) ([]ExportRun, []ExportPercentile) {
+	var runs []ExportRun
+	var percentiles []ExportPercentile
+	for _, run := range transport.Runs {
+		distributions := []namedSummary{{"all", run.All}, {"cold", run.Cold}, {"warm", run.Warm}}
+		if run.Invocations != nil {
+			distributions = append(distributions, namedSummary{"init_duration", run.Invocations.InitDuration})
+		}
+		if run.SteadyState != nil {
+			distributions = append(distributions, namedSummary{"steady_state", run.SteadyState.Latency})
+		}
+		for _, distribution := range distributions {
+			runs = append(runs, ExportRun{
+				AnalysisId:      analysisId,
+				TestRunId:       run.TestRunId,
+				Backend:         transport.Backend,
+				Aggregator:      run.Aggregator,
+				Distribution:    distribution.name,
+				Count:           int64(distribution.summary.Count),
+				MeanMs:          distribution.summary.Mean,
+				StdDevMs:        distribution.summary.StdDev,
+				TrimmedMeanMs:   distribution.summary.TrimmedMean,
+				ColdStarts:      int64(run.ColdStarts),
+				FirstReceivedUs: microseconds(run.FirstReceived),
+				LastReceivedUs:  microseconds(run.LastReceived),
+				DurationSeconds: run.DurationSeconds,
+				Throughput:      run.Throughput,
+			})
+			for _, percentile := range distribution.summary.Percentiles {
+				exported := ExportPercentile{
+					AnalysisId:   analysisId,
+					TestRunId:    run.TestRunId,
+					Distribution: distribution.name,
+					Quantile:     percentile.Quantile,
+					ValueMs:      percentile.Value,
+					Insufficient: percentile.Insufficient,
+				}
+				if percentile.Interval != nil {
+					exported.LowerMs, exported.UpperMs = percentile.Interval.Lower, percentile.Interval.Upper
+				}
+				percentiles = append(percentiles, exported)
+			}
+		}
+	}
+	return runs, percentiles
+}
+
+// encodeRows encodes a slice of one of the export row types in a format.
+func encodeRows(format string, rows interface{}) ([]byte, error) {
+	values := reflect.ValueOf(rows)
+	var encoded bytes.Buffer
+	switch format {
+	case exportJSONL:
+		encoder := json.NewEncoder(&encoded)
+		for i := 0; i < values.Len(); i++ {
+			if err := encoder.Encode(values.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	case exportCSV:
+		w := csv.NewWriter(&encoded)
+		rowType := values.Type().Elem()
+		header := make([]string, rowType.NumField())
+		for j := range header {
+			header[j] = strings.Split(rowType.Field(j).Tag.Get("json"), ",")[0]
+		}
+		_ = w.Write(header)
+		for i := 0; i < values.Len(); i++ {
+			row := values.Index(i)
+			record := make([]string, row.NumField())
+			for j := range record {
+				record[j] = csvValue(row.Field(j))
+			}
+			_ = w.Write(record)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	case exportParquet:
+		pw, err := writer.NewParquetWriterFromWriter(&encoded, reflect.New(values.Type().Elem()).Interface(), 1)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < values.Len(); i++ {
+			if err := pw.Write(values.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		if err := pw.WriteStop(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown export format %s", format)
+	}
+	return encoded.Bytes(), nil
+}
+
+func csvValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.String:
+		return value.String()
+	case reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'f', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool())
+	default:
+		return fmt.Sprint(value.Interface())
+	}
+}
+
+// exportPartition is the Hive-style partition of the exports of a transport, e.g.
+// "date=2006-01-02/scenario=default/transport=queue". Runs without a scenario are exported under
+// "default". The date is the start of the run stamped by the producer, which every delivery of the
+// run carries, so that its records and its summary share a partition however its deliveries are
+// paged. Runs from producers that do not stamp it are exported under the start of the analysis
+// window, which is just as fixed.
+func exportPartition(request AnalyzeRequest, transport string, runStart time.Time) string {
+	scenario := request.Scenario
+	if scenario == "" {
+		scenario = "default"
+	}
+	date := runStart
+	if date.IsZero() {
+		date = *request.StartTime
+	}
+	return fmt.Sprintf("date=%s/scenario=%s/transport=%s", date.UTC().Format("2006-01-02"), scenario, transport)
+}
+
+// writeExport encodes rows in every requested format and writes each to
+// "<table>/<partition>/<name>.<format>", under exportDir when the analyzer runs as a CLI, otherwise
+// under exports/ in the results bucket.
+func writeExport(ctx context.Context, request AnalyzeRequest, table string, partition string, name string, rows interface{}) error {
+	if reflect.ValueOf(rows).Len() == 0 {
+		return nil
+	}
+	for _, format := range request.ExportFormats {
+		encoded, err := encodeRows(format, rows)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s as %s, %w", table, format, err)
+		}
+		path := fmt.Sprintf("%s/%s/%s.%s", table, partition, name, format)
+		if exportDir != "" {
+			path = filepath.Join(exportDir, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, encoded, 0644); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := putObject(ctx, "exports/"+path, encoded, exportContentTypes[format]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var exportContentTypes = map[string]string{
+	exportCSV:     "text/csv",
+	exportJSONL:   "application/x-ndjson",
+	exportParquet: "application/vnd.apache.parquet",
+}
+
+// recordExport buffers the records of a FilterLogEvents scan and writes them out in numbered parts.
+// The part number is checkpointed with the scan, so a resumed scan carries on with the next part.
+// Records are buffered by partition, as the runs of a scan can start on different days.
+type recordExport struct {
+	request    AnalyzeRequest
+	analysisId string
+	transport  string
+	part       int
+	records    map[string][]ExportRecord
+	buffered   int
+}
+
+func newRecordExport(request AnalyzeRequest, analysisId string, transport string, part int) *recordExport {
+	if len(request.ExportFormats) == 0 {
+		return nil
+	}
+	return &recordExport{
+		request:    request,
+		analysisId: analysisId,
+		transport:  transport,
+		part:       part,
+		records:    make(map[string][]ExportRecord),
+	}
+}
+
+// add buffers a record under the partition of the start of its run, and writes out a part once the
+// buffer is full. It does nothing for a nil export, so that scans without exports need not check.
+func (e *recordExport) add(ctx context.Context, output Output, runStart time.Time) error {
+	if e == nil {
+		return nil
+	}
+	partition := exportPartition(e.request, e.transport, runStart)
+	e.records[partition] = append(e.records[partition], newExportRecord(output))
+	e.buffered++
+	if e.buffered < exportPartSize {
+		return nil
+	}
+	return e.flush(ctx)
+}
+
+// flush writes out the buffered records as the next part.
+func (e *recordExport) flush(ctx context.Context) error {
+	if e == nil || e.buffered == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%05d", e.analysisId, e.part)
+	for partition, records := range e.records {
+		if err := writeExport(ctx, e.request, "records", partition, name, records); err != nil {
+			return err
+		}
+	}
+	e.part++
+	e.records = make(map[string][]ExportRecord)
+	e.buffered = 0
+	return nil
+}
+
+// exportTransport writes the summaries of the runs of a transport, under the partition of each run.
+func exportTransport(ctx context.Context, request AnalyzeRequest, analysisId string, transport TransportResult) error {
+	partitions := make(map[string][]RunResult)
+	for _, run := range transport.Runs {
+		var runStart time.Time
+		if run.RunStart != nil {
+			runStart = *run.RunStart
+		}
+		partition := exportPartition(request, transport.Transport, runStart)
+		partitions[partition] = append(partitions[partition], run)
+	}
+	for partition, partitionRuns := range partitions {
+		transport.Runs = partitionRuns
+		runs, percentiles := exportRuns(analysisId, transport)
+		if err := writeExport(ctx, request, "runs", partition, analysisId, runs); err != nil {
+			return err
+		}
+		if err := writeExport(ctx, request, "percentiles", partition, analysisId, percentiles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
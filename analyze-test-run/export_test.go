@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+func TestExportPartitionsByRunStart(t *testing.T) {
+	// A run started just before midnight, whose earliest delivery is paged after a part of its
+	// records was written out.
+	defer func(previous string) { exportDir = previous }(exportDir)
+	exportDir = t.TempDir()
+	request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter, ExportFormats: []string{exportJSONL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStart := time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC)
+	event := func(messageNumber int, sent time.Time) types.FilteredLogEvent {
+		body := fmt.Sprintf(`{"test_run_id":"run","time_sent":%q,"message_number":%d,"run_start":%q}`,
+			sent.Format(time.RFC3339Nano), messageNumber, runStart.Format(time.RFC3339Nano))
+		message := fmt.Sprintf(`{"test_run_id":"run","body":%q,"time_diff_ns":10000000,"message_number":%d}`, body, messageNumber)
+		return types.FilteredLogEvent{Message: aws.String(message)}
+	}
+	ctx := context.Background()
+	scan := newFilterScan()
+	scan.export = newRecordExport(request, "analysis", "queue", 0)
+
+	for i, sent := range []time.Time{runStart.Add(2 * time.Second), runStart.Add(100 * time.Millisecond)} {
+		if err := scan.add(ctx, request, "", nil, event(i, sent)); err != nil {
+			t.Fatal(err)
+		}
+		if err := scan.export.flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transport := TransportResult{Transport: "queue", Backend: backendFilter, Runs: scan.results()}
+	if err := exportTransport(ctx, request, "analysis", transport); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records and the summary are all under the date the run started.
+	var files []string
+	err = filepath.WalkDir(exportDir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files = append(files, filepath.ToSlash(path))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("expected 2 parts of records, the runs and the percentiles, got %v", files)
+	}
+	for _, file := range files {
+		if !strings.Contains(file, "/date=2024-05-01/scenario=default/transport=queue/") {
+			t.Errorf("expected %s under the date the run started", file)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// histogramBins is the number of logarithmic bins of the latency histograms.
+const histogramBins = 40
+
+// htmlReportTemplate renders a single static page, with every chart inlined as SVG so that the
+// report can be opened from anywhere without network access.
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percentileName": percentileName,
+	"percent": func(fraction float64) float64 {
+		return fraction * 100
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Benchmark report {{.Result.AnalysisId}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+pre { background: #f6f6f6; padding: 1em; overflow-x: auto; }
+.insufficient { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Benchmark report</h1>
+<p>Analysis {{.Result.AnalysisId}}, from {{.Result.StartTime.Format "2006-01-02 15:04:05 MST"}} to {{.Result.EndTime.Format "2006-01-02 15:04:05 MST"}}, generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}.</p>
+
+<h2>Latency distribution</h2>
+{{.CDF}}
+
+{{range .Runs}}
+<h2>{{.Transport}}: run {{.Run.TestRunId}}</h2>
+{{with .Run}}<p>{{.All.Count}} deliveries, {{.ColdStarts}} cold starts{{if .DurationSeconds}}, {{printf "%.1f" .DurationSeconds}} s, {{printf "%.1f" .Throughput}} msg/s{{end}}{{with .Invocations}}, {{.Count}} invocations of {{.MemorySizeMb}} MB{{end}}.</p>{{end}}
+<table>
+<tr><th>latency (ms)</th><th>count</th><th>mean</th><th>stddev</th>{{range .Run.All.Percentiles}}<th>{{percentileName .Quantile}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Label}}</td><td>{{.Summary.Count}}</td>{{if .Summary.Count}}<td>{{printf "%.3f" .Summary.Mean}}</td><td>{{printf "%.3f" .Summary.StdDev}}</td>{{range .Summary.Percentiles}}<td{{if .Insufficient}} class="insufficient" title="too few observations in the tail"{{end}}>{{printf "%.3f" .Value}}{{with .Interval}}<br><small>[{{printf "%.3f" .Lower}}, {{printf "%.3f" .Upper}}]</small>{{end}}</td>{{end}}{{end}}</tr>
+{{end}}</table>
+{{with .Run.Cost}}<h3>Estimated cost</h3>
+<table>
+<tr><th>item</th><th>quantity</th><th>unit</th><th>unit price (USD)</th><th>cost (USD)</th></tr>
+{{range .Items}}<tr><td>{{.Item}}</td><td>{{printf "%.6g" .Quantity}}</td><td>{{.Unit}}</td><td>{{printf "%.6g" .UnitPrice}}</td><td>{{printf "%.6f" .Cost}}</td></tr>
+{{end}}<tr><th>total</th><td></td><td></td><td></td><th>{{printf "%.6f" .Total}}</th></tr>
+</table>
+<p>{{printf "%.4f" .PerMillionMessages}} USD per million messages on {{.Service}} in {{.Region}}.{{range .Missing}} Leaves out {{.}}.{{end}}</p>{{end}}
+{{with .Missing}}<p>Not charted:{{range .}} {{.}}.{{end}}</p>{{end}}
+{{if .Histogram}}{{.Histogram}}{{end}}
+{{if .OverTime}}{{.OverTime}}{{end}}
+{{with .Run.Shape}}<h3>Distribution shape</h3>
+<p>The latency distribution is {{if .Bimodal}}bimodal{{else}}unimodal{{end}} (BIC delta {{printf "%.1f" .BICDelta}}, separation {{printf "%.2f" .Separation}}).</p>
+<table>
+<tr><th>mode</th><th>center (ms)</th><th>95% within (ms)</th><th>deliveries</th><th>share</th><th>cold</th></tr>
+{{range .Modes}}<tr><td>{{.Name}}</td><td>{{printf "%.3f" .Center}}</td><td>{{printf "%.3f" .Lower}} to {{printf "%.3f" .Upper}}</td><td>{{.Count}}</td><td>{{printf "%.1f%%" (percent .Fraction)}}</td><td>{{printf "%.1f%%" (percent .ColdFraction)}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Heatmap}}{{.Heatmap}}{{end}}
+{{with .ServiceMetrics}}<h3>Service metrics</h3>
+<p>CloudWatch metrics of the services the run went through, on the time axis of the percentiles over time.</p>
+{{range .}}{{.}}
+{{end}}{{end}}
+{{if .Run.Groups}}<h3>Breakdown by {{$.GroupBy}}</h3>
+<table>
+<tr><th>group</th><th>count</th><th>mean</th>{{range .Run.All.Percentiles}}<th>{{percentileName .Quantile}}</th>{{end}}</tr>
+{{range .Run.Groups}}<tr><td>{{.Group}}</td><td>{{.Latency.Count}}</td><td>{{printf "%.3f" .Latency.Mean}}</td>{{range .Latency.Percentiles}}<td>{{printf "%.3f" .Value}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .Groups}}{{.Groups}}{{end}}{{end}}
+{{with .Run.Slowest}}<h3>Slowest deliveries</h3>
+<table>
+<tr><th>latency (ms)</th><th>event</th><th>message</th><th>shard</th><th>request</th><th>cold</th><th>sent</th><th>handled</th><th>log event</th></tr>
+{{range .}}<tr><td>{{printf "%.3f" .LatencyMs}}</td><td>{{.EventId}}</td><td>{{.MessageNumber}}</td><td>{{.ShardId}}</td><td>{{.RequestId}}</td><td>{{.ColdStart}}</td><td>{{.TimeSent.Format "15:04:05.000000"}}</td><td>{{.HandlerStartTime.Format "15:04:05.000000"}}</td><td>{{if .URL}}<a href="{{.URL}}">{{.LogTimestamp.Format "15:04:05.000"}}</a>{{else}}{{.LogTimestamp.Format "15:04:05.000"}}{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+
+<h2>Configuration</h2>
+<table>
+{{range $transport, $logGroupName := .LogGroups}}<tr><td>{{$transport}}</td><td>{{$logGroupName}}</td></tr>
+{{end}}</table>
+<pre>{{.Request}}</pre>
+</body>
+</html>
+`))
+
+type htmlReport struct {
+	Result      AnalyzeResult
+	GeneratedAt time.Time
+	CDF         template.HTML
+	Runs        []htmlRun
+	GroupBy     string
+	LogGroups   map[string]string
+	Request     string
+}
+
+type htmlRun struct {
+	Transport string
+	Run       RunResult
+	Rows      []htmlRow
+	Histogram template.HTML
+	OverTime  template.HTML
+	Heatmap   template.HTML
+	Groups    template.HTML
+	// Missing lists the charts of the run that could not be drawn, and why.
+	Missing []string
+	// ServiceMetrics holds a chart per service metric, on the x axis of OverTime.
+	ServiceMetrics []template.HTML
+}
+
+type htmlRow struct {
+	Label   string
+	Summary LatencySummary
+}
+
+// distributionQuantiles are the quantiles kept for the CDF and histogram of a run, every percent
+// and more finely in the tail.
+var distributionQuantiles = func() []float64 {
+	var quantiles []float64
+	for i := 0; i < 100; i++ {
+		quantiles = append(quantiles, float64(i)/100)
+	}
+	return append(quantiles, 0.995, 0.999, 0.9995, 0.9999, 1)
+}()
+
+func distribution(a aggregator) []Percentile {
+	if a.Count() == 0 {
+		return nil
+	}
+	percentiles := make([]Percentile, len(distributionQuantiles))
+	for i, quantile := range distributionQuantiles {
+		percentiles[i] = Percentile{Quantile: quantile, Value: a.Quantile(quantile)}
+	}
+	return percentiles
+}
+
+// cdf interpolates the fraction of values up to a value from the quantiles of a distribution.
+func cdf(distribution []Percentile, value float64) float64 {
+	for i, percentile := range distribution {
+		if percentile.Value < value {
+			continue
+		}
+		if i == 0 {
+			return percentile.Quantile
+		}
+		previous := distribution[i-1]
+		if percentile.Value == previous.Value {
+			return percentile.Quantile
+		}
+		return previous.Quantile + (value-previous.Value)/(percentile.Value-previous.Value)*(percentile.Quantile-previous.Quantile)
+	}
+	return 1
+}
+
+// histogram bins a distribution logarithmically between its lowest positive value and its maximum.
+func histogram(distribution []Percentile) []point {
+	low, high := math.Inf(1), 0.0
+	for _, percentile := range distribution {
+		if percentile.Value > 0 {
+			low = math.Min(low, percentile.Value)
+			high = math.Max(high, percentile.Value)
+		}
+	}
+	if high <= low {
+		return nil
+	}
+	step := (math.Log10(high) - math.Log10(low)) / histogramBins
+	bins := make([]point, histogramBins+1)
+	for i := range bins {
+		bins[i].X = math.Pow(10, math.Log10(low)+float64(i)*step)
+	}
+	for i := 0; i < histogramBins; i++ {
+		bins[i].Y = cdf(distribution, bins[i+1].X) - cdf(distribution, bins[i].X)
+	}
+	return bins
+}
+
+// cdfPoints returns the points of the CDF of a run, from its distribution if it has one, otherwise
+// from its percentiles.
+func cdfPoints(run RunResult) []point {
+	percentiles := run.Distribution
+	if len(percentiles) == 0 {
+		percentiles = run.All.Percentiles
+	}
+	points := make([]point, len(percentiles))
+	for i, percentile := range percentiles {
+		points[i] = point{X: percentile.Value, Y: percentile.Quantile}
+	}
+	return points
+}
+
+// overTimeSeries returns a series per percentile of the time series by receive time, in seconds
+// since its first bucket.
+func overTimeSeries(buckets []TimeBucket) []chartSeries {
+	if len(buckets) == 0 {
+		return nil
+	}
+	var series []chartSeries
+	for k, percentile := range buckets[0].Percentiles {
+		s := chartSeries{Name: percentileName(percentile.Quantile)}
+		for _, bucket := range buckets {
+			s.Points = append(s.Points, point{X: bucket.Start.Sub(buckets[0].Start).Seconds(), Y: bucket.Percentiles[k].Value})
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// timeOrigin is the time the charts over time of a run count seconds from: its first bucket by
+// receive time, or else its first receive.
+func timeOrigin(run RunResult) time.Time {
+	if run.TimeSeries != nil && len(run.TimeSeries.ByReceived) > 0 {
+		return run.TimeSeries.ByReceived[0].Start
+	}
+	return run.FirstReceived
+}
+
+// serviceMetricSeries returns the points of a service metric in seconds since origin.
+func serviceMetricSeries(metric ServiceMetric, origin time.Time) chartSeries {
+	s := chartSeries{Name: strings.ToLower(metric.Stat)}
+	for _, p := range metric.Points {
+		s.Points = append(s.Points, point{X: p.Time.Sub(origin).Seconds(), Y: p.Value})
+	}
+	return s
+}
+
+// xRange returns the lowest and highest x of the points of the series, so that charts over time can
+// share an x axis.
+func xRange(series []chartSeries) (float64, float64) {
+	from, to := math.Inf(1), math.Inf(-1)
+	for _, s := range series {
+		for _, p := range s.Points {
+			from, to = math.Min(from, p.X), math.Max(to, p.X)
+		}
+	}
+	return from, to
+}
+
+// heatmapColumns returns the start of each column of a heatmap in seconds since its first bucket,
+// and the end of the last column.
+func heatmapColumns(heatmap *HeatmapResult) []float64 {
+	width, _ := time.ParseDuration(heatmap.BucketWidth)
+	columns := make([]float64, 0, len(heatmap.Starts)+1)
+	for _, start := range heatmap.Starts {
+		columns = append(columns, start.Sub(heatmap.Starts[0]).Seconds())
+	}
+	return append(columns, columns[len(columns)-1]+width.Seconds())
+}
+
+// groupSeries returns a series per percentile over the groups of a run, in group order.
+func groupSeries(groups []GroupResult) []chartSeries {
+	if len(groups) == 0 || len(groups[0].Latency.Percentiles) == 0 {
+		return nil
+	}
+	var series []chartSeries
+	for k, percentile := range groups[0].Latency.Percentiles {
+		s := chartSeries{Name: percentileName(percentile.Quantile)}
+		for i, group := range groups {
+			if k < len(group.Latency.Percentiles) {
+				s.Points = append(s.Points, point{X: float64(i), Y: group.Latency.Percentiles[k].Value})
+			}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+func renderHTMLReport(request AnalyzeRequest, result AnalyzeResult) ([]byte, error) {
+	serialized, _ := json.MarshalIndent(request, "", "  ")
+	report := htmlReport{
+		Result:      result,
+		GeneratedAt: time.Now().UTC(),
+		GroupBy:     strings.Join(request.GroupBy, ", "),
+		LogGroups:   make(map[string]string),
+		Request:     string(serialized),
+	}
+	var cdfSeries []chartSeries
+	for _, transport := range result.Transports {
+		report.LogGroups[transport.Transport] = transport.LogGroupName
+		for _, run := range transport.Runs {
+			label := transport.Transport + " " + run.TestRunId
+			if len(label) > 24 {
+				label = label[:24] + "…"
+			}
+			cdfSeries = append(cdfSeries, chartSeries{Name: label, Points: cdfPoints(run)})
+			htmlRun := htmlRun{
+				Transport: transport.Transport,
+				Run:       run,
+				Rows: []htmlRow{
+					{"all", run.All},
+					{"cold", run.Cold},
+					{"warm", run.Warm},
+				},
+			}
+			if run.SteadyState != nil {
+				htmlRun.Rows = append(htmlRun.Rows, htmlRow{"steady state", run.SteadyState.Latency})
+			}
+			if run.Invocations != nil {
+				htmlRun.Rows = append(htmlRun.Rows,
+					htmlRow{"handler duration", run.Invocations.Duration},
+					htmlRow{"billed duration", run.Invocations.BilledDuration},
+					htmlRow{"init duration", run.Invocations.InitDuration},
+					htmlRow{"max memory used (MB)", run.Invocations.MaxMemoryUsed},
+				)
+			}
+			if bins := histogram(run.Distribution); bins != nil {
+				htmlRun.Histogram = histogramChart(chart{title: "Latency histogram", xLabel: "latency (ms)", yLabel: "fraction of deliveries", logX: true}, bins)
+			} else if len(run.Distribution) == 0 {
+				htmlRun.Missing = append(htmlRun.Missing, "the histogram, and the CDF beyond the reported percentiles, as the run has no full distribution, which only the filter backend keeps")
+			} else {
+				htmlRun.Missing = append(htmlRun.Missing, "the histogram, as every delivery has the same latency")
+			}
+			// The percentiles over time and the service metrics share an x axis spanning both.
+			var overTime []chartSeries
+			if run.TimeSeries != nil && len(run.TimeSeries.ByReceived) > 1 {
+				overTime = overTimeSeries(run.TimeSeries.ByReceived)
+			}
+			var charted []ServiceMetric
+			var metricSeries []chartSeries
+			if run.ServiceMetrics != nil && !timeOrigin(run).IsZero() {
+				for _, metric := range run.ServiceMetrics.Metrics {
+					if len(metric.Points) > 0 {
+						charted = append(charted, metric)
+						metricSeries = append(metricSeries, serviceMetricSeries(metric, timeOrigin(run)))
+					}
+				}
+			}
+			xFrom, xTo := xRange(append(append([]chartSeries(nil), overTime...), metricSeries...))
+			switch {
+			case run.TimeSeries == nil:
+				htmlRun.Missing = append(htmlRun.Missing, "the percentiles over time, as the run has no time series, which only the filter backend keeps")
+			case len(run.TimeSeries.ByReceived) < 2:
+				htmlRun.Missing = append(htmlRun.Missing, "the percentiles over time, as the run was received within a single bucket of "+run.TimeSeries.BucketWidth)
+			}
+			if overTime != nil {
+				htmlRun.OverTime = lineChart(chart{
+					title:  "Percentiles over time, in buckets of " + run.TimeSeries.BucketWidth + " by receive time",
+					xLabel: "seconds since first receive",
+					yLabel: "latency (ms)",
+					xFrom:  xFrom,
+					xTo:    xTo,
+				}, overTime)
+			}
+			for k, metric := range charted {
+				htmlRun.ServiceMetrics = append(htmlRun.ServiceMetrics, lineChart(chart{
+					title:  fmt.Sprintf("%s %s, per %ds", metric.Namespace, metric.Name, run.ServiceMetrics.PeriodSeconds),
+					xLabel: "seconds since first receive",
+					yLabel: metric.Name,
+					xFrom:  xFrom,
+					xTo:    xTo,
+				}, metricSeries[k:k+1]))
+			}
+			if run.Heatmap != nil {
+				htmlRun.Heatmap = heatmapChart(chart{
+					title:  "Deliveries by receive time and latency, in buckets of " + run.Heatmap.BucketWidth,
+					xLabel: "seconds since first receive",
+					yLabel: "latency (ms)",
+					logY:   true,
+				}, heatmapColumns(run.Heatmap), run.Heatmap.Latencies, run.Heatmap.Counts)
+			}
+			switch {
+			case len(run.Groups) > 1:
+				htmlRun.Groups = lineChart(chart{
+					title:  "Percentiles by group, in table order",
+					xLabel: "group",
+					yLabel: "latency (ms)",
+				}, groupSeries(run.Groups))
+			case len(run.Groups) == 1:
+				htmlRun.Missing = append(htmlRun.Missing, "the percentiles by "+report.GroupBy+", as every delivery is in the same group")
+			default:
+				htmlRun.Missing = append(htmlRun.Missing, "the breakdown by group, as the run has no groups, which only the filter backend computes")
+			}
+			report.Runs = append(report.Runs, htmlRun)
+		}
+	}
+	report.CDF = lineChart(chart{title: "Latency CDF", xLabel: "latency (ms)", yLabel: "fraction of deliveries", logX: true}, cdfSeries)
+
+	var rendered bytes.Buffer
+	if err := htmlReportTemplate.Execute(&rendered, report); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+func reportKey(analysisId string) string {
+	return fmt.Sprintf("reports/%s.html", analysisId)
+}
+
+// writeHTMLReport renders the report of a complete analysis to reportPath when the analyzer runs
+// as a CLI, otherwise to the results bucket, and returns where it was written.
+func writeHTMLReport(ctx context.Context, request AnalyzeRequest, result AnalyzeResult) (string, error) {
+	rendered, err := renderHTMLReport(request, result)
+	if err != nil {
+		return "", fmt.Errorf("failed to render report, %w", err)
+	}
+	if reportPath != "" {
+		return reportPath, os.WriteFile(reportPath, rendered, 0644)
+	}
+	key := reportKey(result.AnalysisId)
+	if err := putObject(ctx, key, rendered, "text/html; charset=utf-8"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", resultsBucket, key), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderHTMLReportStatesMissingCharts(t *testing.T) {
+	// A run with only the percentiles Logs Insights provides.
+	run := RunResult{
+		TestRunId: "run",
+		All:       LatencySummary{Count: 100, Percentiles: []Percentile{{Quantile: 0.5, Value: 10}, {Quantile: 0.99, Value: 20}}},
+	}
+	result := AnalyzeResult{AnalysisId: "analysis", Transports: []TransportResult{{Transport: "queue", Runs: []RunResult{run}}}}
+
+	rendered, err := renderHTMLReport(AnalyzeRequest{}, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The report says which charts are missing and why, rather than leaving them out.
+	for _, missing := range []string{"the histogram", "the percentiles over time", "the breakdown by group"} {
+		if !strings.Contains(string(rendered), missing) {
+			t.Errorf("expected the report to state that %s is missing", missing)
+		}
+	}
+}
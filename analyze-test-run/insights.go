@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+const (
+	// backendInsights aggregates server-side with a CloudWatch Logs Insights query. It is fast, but
+	// pct() is approximate and only the overall, cold and warm percentiles are available.
+	backendInsights = "insights"
+	// backendFilter pages through every log event with FilterLogEvents and aggregates locally. It is
+	// slow, but it computes every part of the report from the exact latencies.
+	backendFilter = "filter"
+)
+
+// insightsTimestampLayout is the layout of the @timestamp values returned by Logs Insights.
+const insightsTimestampLayout = "2006-01-02 15:04:05.000"
+
+// insightsQuery builds a Logs Insights query that computes the count, mean, standard deviation and
+// percentiles of the latency in milliseconds for each test run, the time of its first and last log
+// events and the number of invocations that handled it, grouped additionally by the given parsed
+// fields.
+func insightsQuery(testRunIds []string, quantiles []float64, by ...string) string {
+	lines := []string{
+		`parse @message /"test_run_id":"(?<run_id>[^"]*)"/`,
+		`parse @message /"time_diff_ns":(?<latency_ns>\d+)/`,
+		`parse @message /"cold_start":(?<cold>true|false)/`,
+		`parse @message /"function_memory_size":(?<memory>\d+)/`,
+		`parse @message /"batch_size":(?<batch>\d+)/`,
+		`parse @message /"request_id":"(?<request_id>[^"]*)"/`,
+		`filter ispresent(latency_ns)`,
+	}
+	if len(testRunIds) > 0 {
+		quoted := make([]string, len(testRunIds))
+		for i, testRunId := range testRunIds {
+			quoted[i] = strconv.Quote(testRunId)
+		}
+		lines = append(lines, fmt.Sprintf("filter run_id in [%s]", strings.Join(quoted, ", ")))
+	}
+	lines = append(lines, "fields latency_ns / 1000000 as latency_ms")
+	aggregations := []string{
+		"count(*) as count",
+		"avg(latency_ms) as mean",
+		"stddev(latency_ms) as stddev",
+		"min(@timestamp) as first_received",
+		"max(@timestamp) as last_received",
+		"max(memory) as function_memory_size",
+		"max(batch) as max_batch_size",
+		"count_distinct(request_id) as invocations",
+	}
+	for i, quantile := range quantiles {
+		switch quantile {
+		case 0.0:
+			aggregations = append(aggregations, fmt.Sprintf("min(latency_ms) as q%d", i))
+		case 1.0:
+			aggregations = append(aggregations, fmt.Sprintf("max(latency_ms) as q%d", i))
+		default:
+			aggregations = append(aggregations, fmt.Sprintf("pct(latency_ms, %s) as q%d",
+				formatPercent(quantile), i))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("stats %s by %s", strings.Join(aggregations, ", "), strings.Join(append([]string{"run_id"}, by...), ", ")))
+	return strings.Join(lines, " | ")
+}
+
+// insightsDeadlineMargin is how long before the invocation deadline a query is given up on. It
+// leaves the FilterLogEvents fallback time to scan before it stops at deadlineMargin and hands off.
+const insightsDeadlineMargin = deadlineMargin + 20*time.Second
+
+// errInsightsDeadline is returned when a query is given up on before the invocation deadline.
+var errInsightsDeadline = errors.New("query did not complete before the invocation deadline")
+
+// runInsightsQuery starts a query and polls until it completes, returning each result row as a map
+// from field name to value. A query that has not completed by insightsDeadlineMargin before the
+// invocation deadline is stopped. Logs Insights takes the time range in seconds, so the end is rounded
+// up to cover the same window as FilterLogEvents, which takes milliseconds.
+func runInsightsQuery(ctx context.Context, logGroupName string, query string, startTime time.Time, endTime time.Time) ([]map[string]string, error) {
+	started, err := cloudwatchlogsClient.StartQuery(ctx, &cloudwatchlogs.StartQueryInput{
+		LogGroupName: aws.String(logGroupName),
+		QueryString:  aws.String(query),
+		StartTime:    aws.Int64(startTime.Unix()),
+		EndTime:      aws.Int64(endTime.Add(time.Second - 1).Unix()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start query, %w", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			stopInsightsQuery(started.QueryId)
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < insightsDeadlineMargin {
+			stopInsightsQuery(started.QueryId)
+			return nil, errInsightsDeadline
+		}
+		results, err := cloudwatchlogsClient.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{
+			QueryId: started.QueryId,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get query results, %w", err)
+		}
+		switch results.Status {
+		case types.QueryStatusScheduled, types.QueryStatusRunning:
+			continue
+		case types.QueryStatusComplete:
+			rows := make([]map[string]string, len(results.Results))
+			for i, fields := range results.Results {
+				rows[i] = make(map[string]string)
+				for _, field := range fields {
+					rows[i][aws.ToString(field.Field)] = aws.ToString(field.Value)
+				}
+			}
+			return rows, nil
+		default:
+			return nil, fmt.Errorf("query %s finished with status %s", aws.ToString(started.QueryId), results.Status)
+		}
+	}
+}
+
+// stopInsightsQuery stops a query that is given up on, so that it does not keep counting against
+// the concurrent query quota. It has its own timeout, as the context of the query may be done.
+func stopInsightsQuery(queryId *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cloudwatchlogsClient.StopQuery(ctx, &cloudwatchlogs.StopQueryInput{QueryId: queryId}); err != nil {
+		fmt.Printf("failed to stop query %s: %+v\n", aws.ToString(queryId), err)
+	}
+}
+
+// insightsSummary reads the summary of a distribution from a result row. Logs Insights has no
+// trimmed mean, and gives nothing to compute confidence intervals from, so they are left out.
+func insightsSummary(row map[string]string, quantiles []float64) LatencySummary {
+	count, _ := strconv.ParseUint(row["count"], 10, 64)
+	summary := LatencySummary{Count: count}
+	summary.Mean, _ = strconv.ParseFloat(row["mean"], 64)
+	summary.StdDev, _ = strconv.ParseFloat(row["stddev"], 64)
+	for i, quantile := range quantiles {
+		value, _ := strconv.ParseFloat(row[fmt.Sprintf("q%d", i)], 64)
+		summary.Percentiles = append(summary.Percentiles, Percentile{Quantile: quantile, Value: value})
+	}
+	flagInsufficient(&summary)
+	return summary
+}
+
+// analyzeInsights computes the overall, cold and warm latency percentiles and the cold starts of
+// each run with Logs Insights queries. Cold starts are counted with count_distinct, which is
+// approximate for many invocations. Groups, ordering checks, time series and the REPORT lines of
+// the invocations are only available from analyzeFilter.
+func analyzeInsights(ctx context.Context, logGroupName string, request AnalyzeRequest, startTime time.Time, endTime time.Time) ([]RunResult, error) {
+	allRows, err := runInsightsQuery(ctx, logGroupName, insightsQuery(request.TestRunIds, request.Quantiles), startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	coldRows, err := runInsightsQuery(ctx, logGroupName, insightsQuery(request.TestRunIds, request.Quantiles, "cold"), startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make(map[string]*RunResult)
+	for _, row := range allRows {
+		run := &RunResult{TestRunId: row["run_id"], All: insightsSummary(row, request.Quantiles)}
+		// The log events are written when the consumer handles each message, so their first and last
+		// timestamps approximate the first and last receive times, to the millisecond.
+		firstReceived, _ := time.Parse(insightsTimestampLayout, row["first_received"])
+		lastReceived, _ := time.Parse(insightsTimestampLayout, row["last_received"])
+		run.setThroughput(firstReceived, lastReceived)
+		run.FunctionMemorySize, _ = strconv.Atoi(row["function_memory_size"])
+		run.MaxBatchSize, _ = strconv.Atoi(row["max_batch_size"])
+		runs[row["run_id"]] = run
+	}
+	for _, row := range coldRows {
+		run, ok := runs[row["run_id"]]
+		if !ok {
+			continue
+		}
+		if row["cold"] == "true" {
+			run.Cold = insightsSummary(row, request.Quantiles)
+			run.ColdStarts, _ = strconv.Atoi(row["invocations"])
+		} else {
+			run.Warm = insightsSummary(row, request.Quantiles)
+		}
+	}
+
+	results := make([]RunResult, 0, len(runs))
+	for _, run := range runs {
+		if *request.Slowest > 0 {
+			if run.Slowest, err = insightsSlowest(ctx, logGroupName, request, run.TestRunId, startTime, endTime); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, *run)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].TestRunId < results[j].TestRunId
+	})
+	return results, nil
+}
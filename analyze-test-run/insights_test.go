@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInsightsQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		testRunIds []string
+		quantiles  []float64
+		by         []string
+		want       []string
+		wantNot    []string
+	}{
+		{
+			name:      "every run",
+			quantiles: []float64{0, 0.5, 0.999, 1},
+			want: []string{
+				"min(latency_ms) as q0",
+				"pct(latency_ms, 50) as q1",
+				"pct(latency_ms, 99.9) as q2",
+				"max(latency_ms) as q3",
+				"| stats count(*) as count, avg(latency_ms) as mean, stddev(latency_ms) as stddev,",
+				" by run_id",
+			},
+			wantNot: []string{"filter run_id in"},
+		},
+		{
+			name:       "selected runs by cold start",
+			testRunIds: []string{"run-a", "run-b"},
+			quantiles:  []float64{0.5},
+			by:         []string{"cold"},
+			want: []string{
+				`| filter run_id in ["run-a", "run-b"] |`,
+				"count_distinct(request_id) as invocations",
+				" by run_id, cold",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := insightsQuery(test.testRunIds, test.quantiles, test.by...)
+			for _, want := range test.want {
+				if !strings.Contains(query, want) {
+					t.Errorf("expected the query to contain %q, got %s", want, query)
+				}
+			}
+			for _, wantNot := range test.wantNot {
+				if strings.Contains(query, wantNot) {
+					t.Errorf("expected the query not to contain %q, got %s", wantNot, query)
+				}
+			}
+			if !strings.HasSuffix(query, strings.Join(append([]string{"run_id"}, test.by...), ", ")) {
+				t.Errorf("expected the query to end with its grouping, got %s", query)
+			}
+		})
+	}
+}
+
+func TestInsightsSummary(t *testing.T) {
+	quantiles := []float64{0, 0.5, 0.99, 1}
+	tests := []struct {
+		name string
+		row  map[string]string
+		want LatencySummary
+	}{
+		{
+			name: "full row",
+			row:  map[string]string{"count": "2000", "mean": "12.5", "stddev": "3.25", "q0": "4.1", "q1": "11.9", "q2": "30.05", "q3": "52"},
+			want: LatencySummary{Count: 2000, Mean: 12.5, StdDev: 3.25, Percentiles: []Percentile{
+				{Quantile: 0, Value: 4.1},
+				{Quantile: 0.5, Value: 11.9},
+				{Quantile: 0.99, Value: 30.05},
+				{Quantile: 1, Value: 52},
+			}},
+		},
+		{
+			// p99 of 100 latencies has a single observation beyond it.
+			name: "small run",
+			row:  map[string]string{"count": "100", "mean": "10", "stddev": "1", "q0": "8", "q1": "10", "q2": "13", "q3": "14"},
+			want: LatencySummary{Count: 100, Mean: 10, StdDev: 1, Percentiles: []Percentile{
+				{Quantile: 0, Value: 8},
+				{Quantile: 0.5, Value: 10},
+				{Quantile: 0.99, Value: 13, Insufficient: true},
+				{Quantile: 1, Value: 14},
+			}},
+		},
+		{
+			name: "missing fields",
+			row:  map[string]string{"count": "1"},
+			want: LatencySummary{Count: 1, Percentiles: []Percentile{
+				{Quantile: 0},
+				{Quantile: 0.5, Insufficient: true},
+				{Quantile: 0.99, Insufficient: true},
+				{Quantile: 1},
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := insightsSummary(test.row, quantiles); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// lambdaReportPattern matches the REPORT line the Lambda platform logs at the end of every
+// invocation. The init duration is only reported for the first invocation of an execution
+// environment.
+var lambdaReportPattern = regexp.MustCompile(`^REPORT RequestId: (\S+)\s+Duration: ([\d.]+) ms\s+Billed Duration: ([\d.]+) ms\s+Memory Size: (\d+) MB\s+Max Memory Used: (\d+) MB(?:\s+Init Duration: ([\d.]+) ms)?`)
+
+// reportFilterTerm matches REPORT lines in a FilterLogEvents filter pattern.
+const reportFilterTerm = `"REPORT RequestId"`
+
+// lambdaReport is the REPORT line of an invocation.
+type lambdaReport struct {
+	RequestId        string
+	DurationMs       float64
+	BilledDurationMs float64
+	MemorySizeMb     int
+	MaxMemoryUsedMb  float64
+	InitDurationMs   float64
+}
+
+// parseLambdaReport parses a log event as a REPORT line, and reports whether it is one.
+func parseLambdaReport(message string) (lambdaReport, bool) {
+	match := lambdaReportPattern.FindStringSubmatch(message)
+	if match == nil {
+		return lambdaReport{}, false
+	}
+	report := lambdaReport{RequestId: match[1]}
+	report.DurationMs, _ = strconv.ParseFloat(match[2], 64)
+	report.BilledDurationMs, _ = strconv.ParseFloat(match[3], 64)
+	report.MemorySizeMb, _ = strconv.Atoi(match[4])
+	report.MaxMemoryUsedMb, _ = strconv.ParseFloat(match[5], 64)
+	if match[6] != "" {
+		report.InitDurationMs, _ = strconv.ParseFloat(match[6], 64)
+	}
+	return report, true
+}
+
+// invocationAggregate holds the distributions of the REPORT lines of the invocations that handled
+// the deliveries of a run.
+type invocationAggregate struct {
+	count          uint64
+	memorySizeMb   int
+	totalBilledMs  float64
+	duration       aggregator
+	billedDuration aggregator
+	maxMemoryUsed  aggregator
+	initDuration   aggregator
+}
+
+// InvocationsResult summarizes the invocations of the consumer function that handled a run, as
+// reported by the Lambda platform. Durations are in milliseconds, MaxMemoryUsed in megabytes; the
+// init duration is only reported for cold invocations.
+type InvocationsResult struct {
+	Count                 uint64         `json:"count"`
+	MemorySizeMb          int            `json:"memory_size_mb"`
+	TotalBilledDurationMs float64        `json:"total_billed_duration_ms"`
+	Duration              LatencySummary `json:"duration"`
+	BilledDuration        LatencySummary `json:"billed_duration"`
+	MaxMemoryUsed         LatencySummary `json:"max_memory_used"`
+	InitDuration          LatencySummary `json:"init_duration"`
+}
+
+// invocationState is the serialized form of an invocationAggregate.
+type invocationState struct {
+	Count          uint64          `json:"count"`
+	MemorySizeMb   int             `json:"memory_size_mb"`
+	TotalBilledMs  float64         `json:"total_billed_ms"`
+	Duration       aggregatorState `json:"duration"`
+	BilledDuration aggregatorState `json:"billed_duration"`
+	MaxMemoryUsed  aggregatorState `json:"max_memory_used"`
+	InitDuration   aggregatorState `json:"init_duration"`
+}
+
+func newInvocationAggregate(request AnalyzeRequest) *invocationAggregate {
+	return &invocationAggregate{
+		duration:       request.newAggregator(1000),
+		billedDuration: request.newAggregator(1000),
+		maxMemoryUsed:  request.newAggregator(100),
+		initDuration:   request.newAggregator(100),
+	}
+}
+
+func (a *invocationAggregate) add(report lambdaReport) {
+	a.count++
+	a.memorySizeMb = report.MemorySizeMb
+	a.totalBilledMs += report.BilledDurationMs
+	a.duration.Add(report.DurationMs)
+	a.billedDuration.Add(report.BilledDurationMs)
+	a.maxMemoryUsed.Add(report.MaxMemoryUsedMb)
+	if report.InitDurationMs > 0 {
+		a.initDuration.Add(report.InitDurationMs)
+	}
+}
+
+// result summarizes the invocations, or returns nil if no REPORT line was joined to the run.
+func (a *invocationAggregate) result(request AnalyzeRequest) *InvocationsResult {
+	if a.count == 0 {
+		return nil
+	}
+	return &InvocationsResult{
+		Count:                 a.count,
+		MemorySizeMb:          a.memorySizeMb,
+		TotalBilledDurationMs: a.totalBilledMs,
+		Duration:              request.summarize(a.duration, nil),
+		BilledDuration:        request.summarize(a.billedDuration, nil),
+		MaxMemoryUsed:         request.summarize(a.maxMemoryUsed, nil),
+		InitDuration:          request.summarize(a.initDuration, nil),
+	}
+}
+
+func (a *invocationAggregate) state() invocationState {
+	return invocationState{
+		Count:          a.count,
+		MemorySizeMb:   a.memorySizeMb,
+		TotalBilledMs:  a.totalBilledMs,
+		Duration:       marshalAggregator(a.duration),
+		BilledDuration: marshalAggregator(a.billedDuration),
+		MaxMemoryUsed:  marshalAggregator(a.maxMemoryUsed),
+		InitDuration:   marshalAggregator(a.initDuration),
+	}
+}
+
+func (a *invocationAggregate) restore(state invocationState) error {
+	a.count = state.Count
+	a.memorySizeMb = state.MemorySizeMb
+	a.totalBilledMs = state.TotalBilledMs
+	for _, restored := range []struct {
+		target *aggregator
+		state  aggregatorState
+	}{
+		{&a.duration, state.Duration},
+		{&a.billedDuration, state.BilledDuration},
+		{&a.maxMemoryUsed, state.MaxMemoryUsed},
+		{&a.initDuration, state.InitDuration},
+	} {
+		if restored.state.Kind == "" {
+			continue
+		}
+		var err error
+		if *restored.target, err = unmarshalAggregator(restored.state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printInvocations(testRunId string, invocations *InvocationsResult) {
+	fmt.Printf("testRunId %s, invocations = %d, memory size = %d MB, total billed duration = %.0f ms\n",
+		testRunId, invocations.Count, invocations.MemorySizeMb, invocations.TotalBilledDurationMs)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+func TestParseLambdaReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    lambdaReport
+		wantOk  bool
+	}{
+		{
+			name:    "warm",
+			message: "REPORT RequestId: 3f1c\tDuration: 12.34 ms\tBilled Duration: 13 ms\tMemory Size: 128 MB\tMax Memory Used: 31 MB\t\n",
+			want:    lambdaReport{RequestId: "3f1c", DurationMs: 12.34, BilledDurationMs: 13, MemorySizeMb: 128, MaxMemoryUsedMb: 31},
+			wantOk:  true,
+		},
+		{
+			name:    "cold",
+			message: "REPORT RequestId: 9a2b\tDuration: 1.50 ms\tBilled Duration: 52 ms\tMemory Size: 256 MB\tMax Memory Used: 20 MB\tInit Duration: 50.25 ms\t\n",
+			want:    lambdaReport{RequestId: "9a2b", DurationMs: 1.5, BilledDurationMs: 52, MemorySizeMb: 256, MaxMemoryUsedMb: 20, InitDurationMs: 50.25},
+			wantOk:  true,
+		},
+		{name: "start line", message: "START RequestId: 9a2b Version: $LATEST\n", wantOk: false},
+		{name: "delivery", message: `{"test_run_id":"run","request_id":"9a2b"}`, wantOk: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseLambdaReport(test.message)
+			if ok != test.wantOk || got != test.want {
+				t.Errorf("expected %+v, %v, got %+v, %v", test.want, test.wantOk, got, ok)
+			}
+		})
+	}
+}
+
+func deliveryEvent(testRunId string, requestId string, at int64) types.FilteredLogEvent {
+	message := fmt.Sprintf(`{"test_run_id":%q,"time_diff_ns":1000000,"request_id":%q}`, testRunId, requestId)
+	return types.FilteredLogEvent{Message: aws.String(message), Timestamp: aws.Int64(at)}
+}
+
+func reportEvent(requestId string, at int64) types.FilteredLogEvent {
+	message := fmt.Sprintf("REPORT RequestId: %s\tDuration: 2.00 ms\tBilled Duration: 2 ms\tMemory Size: 128 MB\tMax Memory Used: 30 MB\t", requestId)
+	return types.FilteredLogEvent{Message: aws.String(message), Timestamp: aws.Int64(at)}
+}
+
+func TestFilterScanJoinsReportLines(t *testing.T) {
+	start, timeout := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).UnixMilli(), consumerTimeout.Milliseconds()
+	tests := []struct {
+		name   string
+		events []types.FilteredLogEvent
+		want   map[string]uint64
+	}{
+		{
+			name:   "invocation of a single run",
+			events: []types.FilteredLogEvent{deliveryEvent("a", "r1", start), deliveryEvent("a", "r1", start+1), reportEvent("r1", start+2)},
+			want:   map[string]uint64{"a": 1},
+		},
+		{
+			name:   "invocation of two runs",
+			events: []types.FilteredLogEvent{deliveryEvent("a", "r1", start), deliveryEvent("b", "r1", start+1), reportEvent("r1", start+2)},
+			want:   map[string]uint64{"a": 1, "b": 1},
+		},
+		{
+			name: "report after the timeout",
+			events: []types.FilteredLogEvent{
+				deliveryEvent("a", "r1", start),
+				deliveryEvent("a", "r2", start+timeout+1),
+				reportEvent("r1", start+timeout+2),
+				reportEvent("r2", start+timeout+3),
+			},
+			want: map[string]uint64{"a": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			scan := newFilterScan()
+			for _, event := range test.events {
+				if err := scan.add(context.Background(), request, "", map[string]bool{}, event); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for testRunId, want := range test.want {
+				if got := scan.aggregation[testRunId].invocations.count; got != want {
+					t.Errorf("expected %d invocations joined to run %s, got %d", want, testRunId, got)
+				}
+			}
+			if len(scan.requests) != 0 {
+				t.Errorf("expected no pending invocations, got %d", len(scan.requests))
+			}
+		})
+	}
+}
+
+func TestFilterScanEvictsOverdueInvocations(t *testing.T) {
+	request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan := newFilterScan()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).UnixMilli()
+	// The REPORT line of r1 falls outside of the time range, so it is never seen.
+	for _, event := range []types.FilteredLogEvent{
+		deliveryEvent("a", "r1", start),
+		deliveryEvent("a", "r2", start+consumerTimeout.Milliseconds()+1),
+	} {
+		if err := scan.add(context.Background(), request, "", map[string]bool{}, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := scan.requests["r1"]; ok {
+		t.Errorf("expected r1 to be evicted once its REPORT line is overdue")
+	}
+	if _, ok := scan.requests["r2"]; !ok {
+		t.Errorf("expected r2 to be pending")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// backendFile reads exported log events from files and aggregates locally like backendFilter, so
+// that runs can be analyzed without AWS access.
+const backendFile = "file"
+
+// maxLogLineBytes bounds a line of a log file, above the 256 KiB limit of a CloudWatch log event
+// and the JSON it is wrapped in.
+const maxLogLineBytes = 1 << 20
+
+// logFiles are the files the analyzer reads log events from instead of CloudWatch Logs when it runs
+// offline, "-" for stdin. The time range of the request is not applied to them.
+var logFiles []string
+
+// logFileEvent is a log event as exported by the CLI, e.g. by aws logs filter-log-events with
+// --output json piped through jq -c '.events[]'.
+type logFileEvent struct {
+	EventId       string  `json:"eventId"`
+	LogStreamName string  `json:"logStreamName"`
+	Timestamp     *int64  `json:"timestamp"`
+	Message       *string `json:"message"`
+}
+
+// outputTransport infers the transport a delivery was logged by, as log files do not tell: only
+// the stream consumer logs a shard ID.
+func outputTransport(output Output) string {
+	if output.ShardId != "" {
+		return "stream"
+	}
+	return "queue"
+}
+
+// parseLogLine reads a line of a log file, either a CloudWatch log event as JSON or a message as it
+// was logged: an Output line or a REPORT line.
+func parseLogLine(line []byte) types.FilteredLogEvent {
+	var exported logFileEvent
+	if err := json.Unmarshal(line, &exported); err == nil && exported.Message != nil {
+		event := types.FilteredLogEvent{Message: exported.Message, Timestamp: exported.Timestamp}
+		if exported.EventId != "" {
+			event.EventId = aws.String(exported.EventId)
+		}
+		if exported.LogStreamName != "" {
+			event.LogStreamName = aws.String(exported.LogStreamName)
+		}
+		return event
+	}
+	return types.FilteredLogEvent{Message: aws.String(string(line))}
+}
+
+// analyzeReader aggregates the log events of a log file, one per line, into the scan. Blank lines
+// and lines that are neither deliveries nor REPORT lines are skipped.
+func analyzeReader(ctx context.Context, name string, r io.Reader, request AnalyzeRequest, scan *filterScan) error {
+	wanted := wantedRuns(request)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := scan.add(ctx, request, "", wanted, parseLogLine(line)); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s, %w", name, err)
+	}
+	return nil
+}
+
+// analyzeFiles aggregates the log events of logFiles, in order, so that REPORT lines are joined as
+// they are from FilterLogEvents when the files are in the order the events were logged.
+func analyzeFiles(ctx context.Context, request AnalyzeRequest, scan *filterScan) ([]RunResult, error) {
+	for _, name := range logFiles {
+		if name == "-" {
+			if err := analyzeReader(ctx, "stdin", os.Stdin, request, scan); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s, %w", name, err)
+		}
+		err = analyzeReader(ctx, name, file, request, scan)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scan.results(), nil
+}
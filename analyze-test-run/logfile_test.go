@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// analyzeTestdata analyzes a log file of testdata as the CLI does, and returns its runs as JSON.
+func analyzeTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	slowest := 5
+	request, err := resolveRequest(AnalyzeRequest{
+		Backend:     backendFilter,
+		GroupBy:     []string{"batch_index"},
+		Shape:       true,
+		SteadyState: true,
+		Slowest:     &slowest,
+	})
+	if err != nil {
+		t.Fatalf("failed to resolve request: %v", err)
+	}
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scan := newFilterScan()
+	if err := analyzeReader(context.Background(), name, file, request, scan); err != nil {
+		t.Fatalf("failed to analyze %s: %v", name, err)
+	}
+	serialized, err := json.MarshalIndent(scan.results(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(serialized, '\n')
+}
+
+func TestAnalyzeReaderGolden(t *testing.T) {
+	for _, name := range []string{"events.jsonl", "outputs.jsonl"} {
+		t.Run(name, func(t *testing.T) {
+			// events.jsonl holds exported CloudWatch log events, outputs.jsonl raw Output lines.
+			golden := filepath.Join("testdata", strings.TrimSuffix(name, ".jsonl")+".golden.json")
+
+			got := analyzeTestdata(t, name)
+
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file, run go test -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("runs of %s differ from %s, run go test -update if the change is intended", name, golden)
+			}
+		})
+	}
+}
+
+func TestTestdataIsConsistent(t *testing.T) {
+	for _, name := range []string{"events.jsonl", "outputs.jsonl"} {
+		t.Run(name, func(t *testing.T) {
+			contents, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cold := make(map[string]bool)
+			handlerStarts := make(map[string]string)
+
+			for _, line := range bytes.Split(contents, []byte("\n")) {
+				event := parseLogLine(line)
+				var output Output
+				if err := json.Unmarshal([]byte(*event.Message), &output); err != nil || output.TestRunId == "" {
+					continue
+				}
+
+				// Every delivery of an invocation shares its cold start and handler start, and is
+				// received and logged after the handler started.
+				if previous, ok := cold[output.RequestId]; ok && previous != output.ColdStart {
+					t.Errorf("request %s is logged both cold and warm", output.RequestId)
+				}
+				cold[output.RequestId] = output.ColdStart
+				if previous, ok := handlerStarts[output.RequestId]; ok && previous != output.HandlerStartTime {
+					t.Errorf("request %s is logged with handler starts %s and %s", output.RequestId, previous, output.HandlerStartTime)
+				}
+				handlerStarts[output.RequestId] = output.HandlerStartTime
+				handlerStart, _ := time.Parse(time.RFC3339Nano, output.HandlerStartTime)
+				datum, _ := output.datum()
+				sentAt, _ := datum.sentAt()
+				if receivedAt(sentAt, output).Before(handlerStart) {
+					t.Errorf("message %d is received before its handler started", output.MessageNumber)
+				}
+				if event.Timestamp != nil && time.UnixMilli(*event.Timestamp).Before(handlerStart.Truncate(time.Millisecond)) {
+					t.Errorf("message %d is logged before its handler started", output.MessageNumber)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeReaderJoinsReportLines(t *testing.T) {
+	// events.jsonl has a REPORT line after the deliveries of every invocation.
+	var runs []RunResult
+
+	if err := json.Unmarshal(analyzeTestdata(t, "events.jsonl"), &runs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(runs))
+	}
+	for _, run := range runs {
+		if run.Invocations == nil || run.Invocations.Count != 40 {
+			t.Errorf("expected 40 invocations of %s, got %+v", run.TestRunId, run.Invocations)
+		}
+		if run.All.Count != 120 {
+			t.Errorf("expected 120 deliveries of %s, got %d", run.TestRunId, run.All.Count)
+		}
+	}
+}
+
+func TestParseLogLine(t *testing.T) {
+	exported := []byte(`{"eventId":"1","logStreamName":"stream","timestamp":1714564800000,"message":"{\"test_run_id\":\"run\"}"}`)
+	raw := []byte(`{"test_run_id":"run"}`)
+
+	exportedEvent, rawEvent := parseLogLine(exported), parseLogLine(raw)
+
+	// Both carry the message, and only the exported one its log stream and timestamp.
+	if *exportedEvent.Message != `{"test_run_id":"run"}` || *exportedEvent.LogStreamName != "stream" || *exportedEvent.Timestamp != 1714564800000 {
+		t.Errorf("unexpected exported event %+v", exportedEvent)
+	}
+	if *rawEvent.Message != string(raw) || rawEvent.LogStreamName != nil || rawEvent.Timestamp != nil {
+		t.Errorf("unexpected raw event %+v", rawEvent)
+	}
+}
@@ -3,106 +3,820 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
-	"github.com/caio/go-tdigest/v4"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"go.uber.org/ratelimit"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
 	region               string
-	queueLogGroupName    string
-	streamLogGroupName   string
+	groupBy              []string
+	defaultBackend       string
+	logGroupNames        map[string]string
+	stackName            string
+	logGroupsDiscovered  bool
+	resultsBucket        string
 	cloudwatchlogsClient *cloudwatchlogs.Client
 	cloudformationClient *cloudformation.Client
+	s3Client             *s3.Client
+	lambdaClient         *awslambda.Client
+	cloudwatchClient     *cloudwatch.Client
+	// reportPath is the local file the HTML report is written to when the analyzer runs as a CLI.
+	reportPath string
+	// exportDir is the local directory exports are written to when the analyzer runs as a CLI.
+	exportDir string
+	// openMetricsEndpoint and influxEndpoint are where the run summaries of complete analyses are
+	// pushed, if set. influxToken authenticates to InfluxDB.
+	openMetricsEndpoint string
+	influxEndpoint      string
+	influxToken         string
+	// consumerTimeout is the timeout of the consumer functions, from CONSUMER_TIMEOUT. An invocation
+	// logs its REPORT line at most this long after its deliveries.
+	consumerTimeout = 15 * time.Second
 )
 
+// deadlineMargin is how long before the invocation deadline a FilterLogEvents scan stops, leaving
+// time to write the checkpoint and hand off to the next invocation.
+const deadlineMargin = 20 * time.Second
+
+type Datum struct {
+	TestRunId     string `json:"test_run_id"`
+	TimeSent      string `json:"time_sent"`
+	MessageNumber int    `json:"message_number"`
+	// WarmUp is stamped by the producer on messages sent during the warm-up of the run.
+	WarmUp bool `json:"warm_up"`
+	// RunStart is stamped by the producer on every message of the run, see runStartOf.
+	RunStart string `json:"run_start"`
+}
+
 type Output struct {
-	TestRunId  string `json:"test_run_id"`
-	EventId    string `json:"event_id"`
-	Body       string `json:"body"`
-	TimeDiffNs int    `json:"time_diff_ns"`
+	TestRunId      string `json:"test_run_id"`
+	EventId        string `json:"event_id"`
+	Body           string `json:"body"`
+	TimeDiffNs     int    `json:"time_diff_ns"`
+	WorkDurationNs int    `json:"work_duration_ns"`
+	RequestId      string `json:"request_id"`
+	ColdStart      bool   `json:"cold_start"`
+
+	FunctionMemorySize      int    `json:"function_memory_size"`
+	Architecture            string `json:"architecture"`
+	ShardId                 string `json:"shard_id"`
+	SequenceNumber          string `json:"sequence_number"`
+	ApproximateReceiveCount int    `json:"approximate_receive_count"`
+	BatchIndex              int    `json:"batch_index"`
+	BatchSize               int    `json:"batch_size"`
+	HandlerStartTime        string `json:"handler_start_time"`
+
+	MessageNumber int    `json:"message_number"`
+	PartitionKey  string `json:"partition_key"`
+}
+
+// datum parses the message body the producer sent.
+func (output Output) datum() (Datum, bool) {
+	var datum Datum
+	err := json.Unmarshal([]byte(output.Body), &datum)
+	return datum, err == nil
 }
 
-func analyze(logGroupName string) error {
-	aggregation := make(map[string]*tdigest.TDigest)
-	now := time.Now()
-	timeWindow, err := time.ParseDuration("6h")
+// runStartOf is the start of the run the producer stamped into the message, the same in every
+// message of the run. Messages from producers that do not stamp it have none.
+func (datum Datum) runStartOf() (time.Time, bool) {
+	runStart, err := time.Parse(time.RFC3339Nano, datum.RunStart)
 	if err != nil {
-		return err
+		return time.Time{}, false
+	}
+	return runStart, true
+}
+
+// sentAt is the time the producer stamped into the message.
+func (datum Datum) sentAt() (time.Time, bool) {
+	timeSent, err := time.Parse(time.RFC3339Nano, datum.TimeSent)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return timeSent, true
+}
+
+// receivedAt is the time the consumer received the message, derived from the time it was sent and
+// the latency the consumer measured.
+func receivedAt(sentAt time.Time, output Output) time.Time {
+	return sentAt.Add(time.Duration(output.TimeDiffNs))
+}
+
+// dimensions are the Output fields that percentiles can be grouped by, keyed by their JSON name.
+var dimensions = map[string]func(Output) string{
+	"request_id":           func(o Output) string { return o.RequestId },
+	"cold_start":           func(o Output) string { return strconv.FormatBool(o.ColdStart) },
+	"function_memory_size": func(o Output) string { return strconv.Itoa(o.FunctionMemorySize) },
+	"architecture":         func(o Output) string { return o.Architecture },
+	"shard_id":             func(o Output) string { return o.ShardId },
+	"sequence_number":      func(o Output) string { return o.SequenceNumber },
+	"approximate_receive_count": func(o Output) string {
+		return strconv.Itoa(o.ApproximateReceiveCount)
+	},
+	"batch_index":   func(o Output) string { return strconv.Itoa(o.BatchIndex) },
+	"batch_size":    func(o Output) string { return strconv.Itoa(o.BatchSize) },
+	"partition_key": func(o Output) string { return o.PartitionKey },
+	// Handler start times are truncated to the second, otherwise every invocation is its own group.
+	"handler_start_time": func(o Output) string {
+		handlerStartTime, err := time.Parse(time.RFC3339Nano, o.HandlerStartTime)
+		if err != nil {
+			return ""
+		}
+		return handlerStartTime.Truncate(time.Second).Format(time.RFC3339)
+	},
+}
+
+// groupKey formats the values of the groupBy dimensions of an output, e.g. "shard_id=shardId-000000000001".
+func groupKey(output Output, groupBy []string) string {
+	parts := make([]string, len(groupBy))
+	for i, dimension := range groupBy {
+		parts[i] = dimension + "=" + dimensions[dimension](output)
+	}
+	return strings.Join(parts, ",")
+}
+
+// AnalyzeRequest selects what the handler analyzes. Every field is optional: by default every run
+// logged in the last 6 hours is analyzed for every transport.
+type AnalyzeRequest struct {
+	TestRunIds []string   `json:"test_run_ids"`
+	StartTime  *time.Time `json:"start_time"`
+	EndTime    *time.Time `json:"end_time"`
+	Transports []string   `json:"transports"`
+	GroupBy    []string   `json:"group_by"`
+	// Backend is either "insights" or "filter", see backendInsights and backendFilter. It defaults to
+	// ANALYZER_BACKEND, or to "filter" when the request asks for analyses only FilterLogEvents
+	// provides, see filterOnly.
+	Backend string `json:"backend"`
+	// CheckpointKey resumes a suspended analysis from its checkpoint. The other fields are ignored,
+	// the request stored in the checkpoint is used instead.
+	CheckpointKey string `json:"checkpoint_key,omitempty"`
+	// Aggregator is either "tdigest" or "hdr". SignificantFigures sets the precision of "hdr", from
+	// 1 to maxSignificantFigures.
+	Aggregator         string `json:"aggregator"`
+	SignificantFigures int    `json:"significant_figures"`
+	// CrossCheck compares the t-digest and HDR histogram quantiles to the exact quantiles of runs
+	// of up to crossCheckLimit deliveries.
+	CrossCheck bool `json:"cross_check"`
+	// Quantiles are the percentiles to report, between 0 and 1, e.g. 0.999 for p99.9.
+	Quantiles []float64 `json:"quantiles"`
+	// TrimFraction is the fraction of the lowest and of the highest latencies left out of the
+	// trimmed mean.
+	TrimFraction *float64 `json:"trim_fraction"`
+	// Interval is how percentile confidence intervals are computed, either "order_statistic" or
+	// "bootstrap", see intervalOrderStatistic and intervalBootstrap. Resamples only applies to
+	// "bootstrap", which is only available for the all, cold and warm distributions, and only for
+	// runs of up to ReservoirSize deliveries, defaultReservoirSize by default.
+	Interval        string  `json:"interval"`
+	ConfidenceLevel float64 `json:"confidence_level"`
+	Resamples       int     `json:"resamples"`
+	ReservoirSize   int     `json:"reservoir_size"`
+	// Compare compares two runs instead of analyzing every run. Both runs are scanned with
+	// FilterLogEvents within the time range of the request.
+	Compare *CompareRequest `json:"compare,omitempty"`
+	// Scenario stores every analyzed run under this name in the results bucket, and compares it to
+	// the baseline of the scenario. A percentile regresses when it exceeds the baseline by more than
+	// its threshold in Thresholds, keyed by percentile name, e.g. "p99", or else RegressionThreshold,
+	// 0.1 by default. A threshold of 0 flags any increase. Runs are stored with their latency
+	// distribution, so Scenario needs the filter backend.
+	Scenario            string             `json:"scenario,omitempty"`
+	RegressionThreshold *float64           `json:"regression_threshold"`
+	Thresholds          map[string]float64 `json:"thresholds,omitempty"`
+	// Promote makes the stored run with this ID the baseline of the scenario, instead of analyzing.
+	Promote string `json:"promote,omitempty"`
+	// BucketWidth adds time series of the latency of each run, in buckets of this width by send time
+	// and by receive time, e.g. "10s". Time series are only available from FilterLogEvents.
+	BucketWidth string `json:"bucket_width,omitempty"`
+	// SteadyState detects the end of the warm-up of each run with MSER, on the mean latency of
+	// buckets of BucketWidth, or 1s, by send time. Warm-up stamped by the producer takes precedence.
+	SteadyState bool `json:"steady_state"`
+	// Shape fits the latency distribution of each run to tell whether it is bimodal, and adds a
+	// heatmap of latency by receive time in buckets of BucketWidth, which it defaults to 10s. The
+	// shape is only available from FilterLogEvents.
+	Shape bool `json:"shape"`
+	// Report renders an HTML report with charts once the analysis is complete, to the results bucket
+	// or, when the analyzer runs as a CLI, to a local file. It implies Shape, and defaults GroupBy to
+	// shard_id for the charts per shard. It needs the filter backend, for the full distribution.
+	Report bool `json:"report"`
+	// Slowest is the number of slowest deliveries listed for each run, 10 by default. 0 leaves the
+	// listing out, and with it the Logs Insights query for it.
+	Slowest *int `json:"slowest"`
+	// ServiceMetrics fetches the CloudWatch metrics of the queue or stream and of the consumer
+	// function of each run, over the time it was received, in periods of BucketWidth rounded up to
+	// whole minutes. Report implies it.
+	ServiceMetrics bool `json:"service_metrics"`
+	// ExportFormats exports the runs and, from FilterLogEvents, every delivery in each of these
+	// formats: "csv", "jsonl" or "parquet". See exportPartition for the layout.
+	ExportFormats []string `json:"export_formats,omitempty"`
+}
+
+// filterOnly returns the fields of the request that ask for analyses only FilterLogEvents provides.
+// Logs Insights only aggregates the percentiles, cold starts and slowest deliveries of each run.
+func (request AnalyzeRequest) filterOnly() []string {
+	var fields []string
+	if len(request.GroupBy) > 0 {
+		fields = append(fields, "group_by")
+	}
+	if request.BucketWidth != "" {
+		fields = append(fields, "bucket_width")
+	}
+	if request.SteadyState {
+		fields = append(fields, "steady_state")
+	}
+	if request.Shape {
+		fields = append(fields, "shape")
+	}
+	if request.Report {
+		fields = append(fields, "report")
+	}
+	if len(request.ExportFormats) > 0 {
+		fields = append(fields, "export_formats")
+	}
+	if request.Scenario != "" && request.Promote == "" {
+		fields = append(fields, "scenario")
+	}
+	return fields
+}
+
+var scenarioPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// filterPattern matches log events that mention any of the test run IDs, and the REPORT lines of
+// the invocations, so that other runs are filtered out by CloudWatch Logs instead of being paged
+// through.
+func filterPattern(testRunIds []string) *string {
+	if len(testRunIds) == 0 {
+		return nil
+	}
+	terms := []string{"?" + reportFilterTerm}
+	for _, testRunId := range testRunIds {
+		terms = append(terms, "?"+strconv.Quote(testRunId))
+	}
+	return aws.String(strings.Join(terms, " "))
+}
+
+// analyze analyzes a log group with the requested backend and returns the backend that produced
+// the results. If a Logs Insights query fails, the log group is analyzed with FilterLogEvents instead.
+// A FilterLogEvents scan that was resumed from a checkpoint carries on with FilterLogEvents. Offline,
+// the log files are analyzed whatever the backend.
+func analyze(ctx context.Context, logGroupName string, request AnalyzeRequest, startTime time.Time, endTime time.Time, scan *filterScan) ([]RunResult, string, error) {
+	if len(logFiles) > 0 {
+		runs, err := analyzeFiles(ctx, request, scan)
+		return runs, backendFile, err
+	}
+	if request.Backend == backendInsights && scan.nextToken == nil {
+		runs, err := analyzeInsights(ctx, logGroupName, request, startTime, endTime)
+		if err == nil {
+			return runs, backendInsights, nil
+		}
+		fmt.Printf("insights query on %s failed, falling back to FilterLogEvents: %+v\n", logGroupName, err)
+	}
+	runs, err := analyzeFilter(ctx, logGroupName, request, startTime, endTime, scan)
+	return runs, backendFilter, err
+}
+
+// filterScan is a FilterLogEvents scan of a log group, which can be suspended before the invocation
+// deadline and resumed from its next token. Requests maps the request ID of each invocation that
+// logged a delivery to the runs of its deliveries, as a batch may hold messages of several runs,
+// until the REPORT line of the invocation is joined to each of them. The platform logs the REPORT
+// line once the handler returns, so it comes after the deliveries of the invocation, and at most
+// consumerTimeout after them.
+type filterScan struct {
+	nextToken   *string
+	aggregation map[string]*runAggregate
+	requests    map[string]*pendingInvocation
+	// nextEviction is the time, in milliseconds, of the next sweep of requests, see evictRequests.
+	nextEviction int64
+	export       *recordExport
+	// transport keeps only the deliveries of this transport, see outputTransport. Log files may
+	// mix transports, log groups never do.
+	transport string
+}
+
+func newFilterScan() *filterScan {
+	return &filterScan{aggregation: make(map[string]*runAggregate), requests: make(map[string]*pendingInvocation)}
+}
+
+// pendingInvocation is an invocation whose REPORT line has not been seen yet: the runs it delivered
+// messages of, and the time of its last delivery in milliseconds, 0 if the log events have none.
+type pendingInvocation struct {
+	TestRunIds []string `json:"test_run_ids"`
+	LoggedAt   int64    `json:"logged_at"`
+}
+
+// pend records that an invocation delivered a message of a run at a time in milliseconds.
+func (scan *filterScan) pend(requestId string, testRunId string, loggedAt int64) {
+	pending, ok := scan.requests[requestId]
+	if !ok {
+		pending = &pendingInvocation{}
+		scan.requests[requestId] = pending
+	}
+	known := false
+	for _, pendingRunId := range pending.TestRunIds {
+		known = known || pendingRunId == testRunId
+	}
+	if !known {
+		pending.TestRunIds = append(pending.TestRunIds, testRunId)
+	}
+	if loggedAt > pending.LoggedAt {
+		pending.LoggedAt = loggedAt
+	}
+}
+
+// evictRequests forgets the invocations whose REPORT line is overdue at a time in milliseconds,
+// e.g. because it falls outside of the time range, so that requests does not grow with the scan. It
+// sweeps at most once per consumerTimeout.
+func (scan *filterScan) evictRequests(now int64) {
+	if now < scan.nextEviction {
+		return
 	}
-	startTime := now.Add(-timeWindow).UnixMilli()
+	timeout := consumerTimeout.Milliseconds()
+	for requestId, pending := range scan.requests {
+		if pending.LoggedAt != 0 && now > pending.LoggedAt+timeout {
+			delete(scan.requests, requestId)
+		}
+	}
+	scan.nextEviction = now + timeout
+}
+
+// wantedRuns returns the set of test run IDs of the request, empty if every run is wanted.
+func wantedRuns(request AnalyzeRequest) map[string]bool {
+	wanted := make(map[string]bool)
+	for _, testRunId := range request.TestRunIds {
+		wanted[testRunId] = true
+	}
+	return wanted
+}
+
+func analyzeFilter(ctx context.Context, logGroupName string, request AnalyzeRequest, startTime time.Time, endTime time.Time, scan *filterScan) ([]RunResult, error) {
+	wanted := wantedRuns(request)
 	paginator := cloudwatchlogs.NewFilterLogEventsPaginator(cloudwatchlogsClient, &cloudwatchlogs.FilterLogEventsInput{
-		LogGroupName: aws.String(logGroupName),
-		StartTime:    aws.Int64(startTime),
-		//FilterPattern: aws.String("time_diff_ns"),
+		LogGroupName:  aws.String(logGroupName),
+		StartTime:     aws.Int64(startTime.UnixMilli()),
+		EndTime:       aws.Int64(endTime.UnixMilli()),
+		FilterPattern: filterPattern(request.TestRunIds),
+		NextToken:     scan.nextToken,
 	})
 
 	// FilterLogEvents is throttled to 10 TPS outside of us-east-1
 	rl := ratelimit.New(10)
 
 	for paginator.HasMorePages() {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineMargin {
+			return nil, errDeadline
+		}
 		rl.Take()
-		page, err := paginator.NextPage(context.TODO())
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to get FilterLogEvents page, %w", err)
+			return nil, fmt.Errorf("failed to get FilterLogEvents page, %w", err)
 		}
 		for _, event := range page.Events {
-			//fmt.Printf("tick\n")
-			var output Output
-			err := json.Unmarshal([]byte(*event.Message), &output)
-			if err != nil {
-				//fmt.Printf("could not deserialize event %s: %+v", *event.Message, err)
-				continue
+			if err := scan.add(ctx, request, logGroupName, wanted, event); err != nil {
+				return nil, err
 			}
-			//fmt.Printf("output: %+v\n", output)
-			testRunId := output.TestRunId
-			timeDiff := time.Nanosecond * time.Duration(output.TimeDiffNs)
-			if _, ok := aggregation[testRunId]; !ok {
-				t, _ := tdigest.New(tdigest.Compression(10000))
-				aggregation[testRunId] = t
+		}
+		scan.nextToken = page.NextToken
+	}
+	return scan.results(), nil
+}
+
+// add aggregates a log event into the run it delivered a message of, or joins it to the run as the
+// REPORT line of an invocation. Other log events are skipped.
+func (scan *filterScan) add(ctx context.Context, request AnalyzeRequest, logGroupName string, wanted map[string]bool, event types.FilteredLogEvent) error {
+	if event.Timestamp != nil {
+		scan.evictRequests(*event.Timestamp)
+	}
+	if report, ok := parseLambdaReport(aws.ToString(event.Message)); ok {
+		if pending, ok := scan.requests[report.RequestId]; ok {
+			delete(scan.requests, report.RequestId)
+			// An invocation that delivered messages of several runs counts once in each of them.
+			for _, testRunId := range pending.TestRunIds {
+				scan.aggregation[testRunId].invocations.add(report)
 			}
-			_ = aggregation[testRunId].Add(float64(timeDiff.Milliseconds()))
 		}
+		return nil
+	}
+	var output Output
+	err := json.Unmarshal([]byte(aws.ToString(event.Message)), &output)
+	if err != nil {
+		return nil
 	}
-	for k, digest := range aggregation {
-		fmt.Printf("timeRunId %s, count = %d\n", k, digest.Count())
-		fmt.Printf("timeRunId %s, p0 = %.3f\n", k, digest.Quantile(0.0))
-		fmt.Printf("timeRunId %s, p50 = %.3f\n", k, digest.Quantile(0.5))
-		fmt.Printf("timeRunId %s, p90 = %.3f\n", k, digest.Quantile(0.9))
-		fmt.Printf("timeRunId %s, p99 = %.3f\n", k, digest.Quantile(0.99))
-		fmt.Printf("timeRunId %s, p100 = %.3f\n", k, digest.Quantile(1.0))
+	testRunId := output.TestRunId
+	// The filter pattern matches the run ID anywhere in the event, not just in test_run_id.
+	if len(wanted) > 0 && !wanted[testRunId] {
+		return nil
+	}
+	if scan.transport != "" && outputTransport(output) != scan.transport {
+		return nil
+	}
+	if _, ok := scan.aggregation[testRunId]; !ok {
+		scan.aggregation[testRunId] = newRunAggregate(request)
+	}
+	scan.aggregation[testRunId].add(output)
+	scan.aggregation[testRunId].slowest.add(output, logGroupName, event)
+	if output.RequestId != "" {
+		scan.pend(output.RequestId, testRunId, aws.ToInt64(event.Timestamp))
+	}
+	if err := scan.export.add(ctx, output, scan.aggregation[testRunId].runStart); err != nil {
+		return fmt.Errorf("failed to export records, %w", err)
 	}
-
 	return nil
 }
 
-func handler() error {
+// results returns the result of every run of the scan, in order of test run ID.
+func (scan *filterScan) results() []RunResult {
+	runs := make([]RunResult, 0, len(scan.aggregation))
+	for testRunId, run := range scan.aggregation {
+		runs = append(runs, run.result(testRunId))
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].TestRunId < runs[j].TestRunId
+	})
+	return runs
+}
+
+// resolveRequest fills in the defaults of a new request and validates it.
+func resolveRequest(request AnalyzeRequest) (AnalyzeRequest, error) {
+	if request.EndTime == nil {
+		endTime := time.Now()
+		request.EndTime = &endTime
+	}
+	if request.StartTime == nil {
+		startTime := request.EndTime.Add(-6 * time.Hour)
+		request.StartTime = &startTime
+	}
+	if len(request.Transports) == 0 {
+		for transport := range logGroupNames {
+			request.Transports = append(request.Transports, transport)
+		}
+		sort.Strings(request.Transports)
+	}
+	for _, transport := range request.Transports {
+		if _, ok := logGroupNames[transport]; !ok {
+			return request, fmt.Errorf("unknown transport %s", transport)
+		}
+	}
+	if len(request.GroupBy) == 0 {
+		request.GroupBy = groupBy
+	}
+	if len(request.GroupBy) == 0 && request.Report {
+		request.GroupBy = []string{"shard_id"}
+	}
+	if request.Report {
+		request.Shape = true
+		request.ServiceMetrics = true
+	}
+	if request.BucketWidth == "" && request.Shape {
+		request.BucketWidth = "10s"
+	}
+	if request.Report && reportPath == "" && resultsBucket == "" {
+		return request, errors.New("RESULTS_BUCKET is not set, cannot upload report")
+	}
+	for _, dimension := range request.GroupBy {
+		if _, ok := dimensions[dimension]; !ok {
+			return request, fmt.Errorf("unknown group by dimension %s", dimension)
+		}
+	}
+	if filterOnly := request.filterOnly(); len(filterOnly) > 0 {
+		if request.Backend == backendInsights {
+			return request, fmt.Errorf("%s need the filter backend, Logs Insights does not provide them", strings.Join(filterOnly, ", "))
+		}
+		request.Backend = backendFilter
+	}
+	if request.Backend == "" {
+		request.Backend = defaultBackend
+	}
+	if request.Backend != backendInsights && request.Backend != backendFilter {
+		return request, fmt.Errorf("unknown backend %s", request.Backend)
+	}
+	if request.Aggregator == "" {
+		request.Aggregator = aggregatorTDigest
+	}
+	if request.Aggregator != aggregatorTDigest && request.Aggregator != aggregatorHdr {
+		return request, fmt.Errorf("unknown aggregator %s", request.Aggregator)
+	}
+	if request.SignificantFigures == 0 {
+		request.SignificantFigures = 3
+	}
+	if request.SignificantFigures < 1 || request.SignificantFigures > maxSignificantFigures {
+		return request, fmt.Errorf("significant figures must be between 1 and %d, got %d", maxSignificantFigures, request.SignificantFigures)
+	}
+	if len(request.Quantiles) == 0 {
+		request.Quantiles = defaultQuantiles
+	}
+	for _, quantile := range request.Quantiles {
+		if quantile < 0 || quantile > 1 {
+			return request, fmt.Errorf("quantiles must be between 0 and 1, got %g", quantile)
+		}
+	}
+	if request.TrimFraction == nil {
+		trimFraction := 0.05
+		request.TrimFraction = &trimFraction
+	}
+	if *request.TrimFraction < 0 || *request.TrimFraction >= 0.5 {
+		return request, fmt.Errorf("trim fraction must be at least 0 and less than 0.5, got %g", *request.TrimFraction)
+	}
+	if request.Interval == "" {
+		request.Interval = intervalOrderStatistic
+	}
+	if request.Interval != intervalOrderStatistic && request.Interval != intervalBootstrap {
+		return request, fmt.Errorf("unknown interval %s", request.Interval)
+	}
+	if request.ConfidenceLevel == 0 {
+		request.ConfidenceLevel = 0.95
+	}
+	if request.ConfidenceLevel <= 0 || request.ConfidenceLevel >= 1 {
+		return request, fmt.Errorf("confidence level must be between 0 and 1, got %g", request.ConfidenceLevel)
+	}
+	if request.Resamples == 0 {
+		request.Resamples = 1000
+	}
+	if request.Resamples < 100 || request.Resamples > 10000 {
+		return request, fmt.Errorf("resamples must be between 100 and 10000, got %d", request.Resamples)
+	}
+	if request.ReservoirSize == 0 {
+		request.ReservoirSize = defaultReservoirSize
+	}
+	if request.ReservoirSize < 1 || request.ReservoirSize > maxReservoirSize {
+		return request, fmt.Errorf("reservoir size must be between 1 and %d, got %d", maxReservoirSize, request.ReservoirSize)
+	}
+	if request.Slowest == nil {
+		slowest := 10
+		request.Slowest = &slowest
+	}
+	if *request.Slowest < 0 || *request.Slowest > 1000 {
+		return request, fmt.Errorf("slowest must be between 0 and 1000, got %d", *request.Slowest)
+	}
+	if request.Compare != nil {
+		if err := resolveCompare(request.Compare); err != nil {
+			return request, err
+		}
+	}
+	if request.Scenario != "" && !scenarioPattern.MatchString(request.Scenario) {
+		return request, fmt.Errorf("scenario must only contain letters, digits, '.', '_' and '-', got %s", request.Scenario)
+	}
+	if (request.Scenario != "" || request.Promote != "") && resultsBucket == "" {
+		return request, errors.New("RESULTS_BUCKET is not set, cannot store runs")
+	}
+	if request.Promote != "" && request.Scenario == "" {
+		return request, errors.New("promote needs the scenario of the run")
+	}
+	if request.BucketWidth != "" {
+		width, err := time.ParseDuration(request.BucketWidth)
+		if err != nil {
+			return request, fmt.Errorf("invalid bucket width %s, %w", request.BucketWidth, err)
+		}
+		if width < time.Millisecond {
+			return request, fmt.Errorf("bucket width must be at least 1ms, got %s", request.BucketWidth)
+		}
+	}
+	for _, format := range request.ExportFormats {
+		if _, ok := exportContentTypes[format]; !ok {
+			return request, fmt.Errorf("unknown export format %s", format)
+		}
+	}
+	if len(request.ExportFormats) > 0 && exportDir == "" && resultsBucket == "" {
+		return request, errors.New("RESULTS_BUCKET is not set, cannot upload exports")
+	}
+	if request.RegressionThreshold == nil {
+		regressionThreshold := defaultRegressionThreshold
+		request.RegressionThreshold = &regressionThreshold
+	}
+	if *request.RegressionThreshold < 0 {
+		return request, fmt.Errorf("regression threshold must be at least 0, got %g", *request.RegressionThreshold)
+	}
+	for name, threshold := range request.Thresholds {
+		if threshold < 0 {
+			return request, fmt.Errorf("threshold of %s must be at least 0, got %g", name, threshold)
+		}
+	}
+	return request, nil
+}
+
+func handler(ctx context.Context, request AnalyzeRequest) (AnalyzeResult, error) {
 	fmt.Printf("handler entry\n")
-	for _, logGroupName := range []string{streamLogGroupName, queueLogGroupName} {
+	loadLogGroups(ctx)
+	var cp checkpoint
+	if request.CheckpointKey != "" {
+		var err error
+		cp, err = loadCheckpoint(ctx, request.CheckpointKey)
+		if err != nil {
+			return AnalyzeResult{}, err
+		}
+		cp.Invocations++
+		fmt.Printf("resuming analysis %s, invocation %d\n", cp.AnalysisId, cp.Invocations)
+	} else {
+		resolved, err := resolveRequest(request)
+		if err != nil {
+			return AnalyzeResult{}, err
+		}
+		cp = checkpoint{AnalysisId: analysisId(ctx), Request: resolved}
+		if resolved.Compare != nil {
+			return handleCompare(ctx, cp.AnalysisId, resolved)
+		}
+		if resolved.Promote != "" {
+			promoted, err := promoteRun(ctx, resolved)
+			return AnalyzeResult{AnalysisId: cp.AnalysisId, Status: statusComplete, Promoted: promoted}, err
+		}
+	}
+	request = cp.Request
+	startTime, endTime := *request.StartTime, *request.EndTime
+
+	result := AnalyzeResult{
+		AnalysisId: cp.AnalysisId,
+		Status:     statusComplete,
+		StartTime:  startTime,
+		EndTime:    endTime,
+		Transports: cp.Completed,
+	}
+	for _, transport := range request.Transports[len(cp.Completed):] {
+		logGroupName := logGroupNames[transport]
+		scan := newFilterScan()
+		exportPart := 0
+		if cp.Transport == transport {
+			var err error
+			scan, err = restoreFilterScan(request, cp.Progress)
+			if err != nil {
+				return AnalyzeResult{}, err
+			}
+			exportPart = cp.Progress.ExportPart
+		}
+		scan.export = newRecordExport(request, cp.AnalysisId, transport, exportPart)
 		fmt.Printf("analyzing log group %s ...\n", logGroupName)
-		err := analyze(logGroupName)
-		fmt.Printf("analyzed log group %s\n", logGroupName)
+		transportResult := TransportResult{Transport: transport, LogGroupName: logGroupName}
+		runs, backend, err := analyze(ctx, logGroupName, request, startTime, endTime, scan)
+		if errors.Is(err, errDeadline) {
+			fmt.Printf("suspending analysis of log group %s before the deadline\n", logGroupName)
+			if err := scan.export.flush(ctx); err != nil {
+				return AnalyzeResult{}, err
+			}
+			cp.Completed = result.Transports
+			cp.Transport = transport
+			cp.Progress = scan.progress()
+			key, err := handOff(ctx, cp)
+			if err != nil {
+				return AnalyzeResult{}, err
+			}
+			result.Status = statusInProgress
+			result.CheckpointKey = key
+			return result, nil
+		}
+		fmt.Printf("analyzed log group %s with backend %s\n", logGroupName, backend)
+		transportResult.Backend = backend
 		if err != nil {
 			fmt.Printf("error analysing %s: %+v\n", logGroupName, err)
+			transportResult.Error = err.Error()
+		}
+		// Service metrics are not available offline.
+		if request.ServiceMetrics && len(logFiles) == 0 {
+			for i := range runs {
+				metrics, err := fetchServiceMetrics(ctx, request, transport, runs[i])
+				if err != nil {
+					fmt.Printf("testRunId %s, failed to fetch service metrics: %+v\n", runs[i].TestRunId, err)
+					continue
+				}
+				runs[i].ServiceMetrics = metrics
+			}
 		}
+		if request.Scenario != "" {
+			storeRuns(ctx, request, transport, runs, scan)
+		}
+		for _, run := range runs {
+			printRunResult(backend, run)
+		}
+		transportResult.Runs = runs
+		if len(request.ExportFormats) > 0 {
+			if err := scan.export.flush(ctx); err != nil {
+				fmt.Printf("failed to export records of %s: %+v\n", logGroupName, err)
+			}
+			if err := exportTransport(ctx, request, cp.AnalysisId, transportResult); err != nil {
+				fmt.Printf("failed to export runs of %s: %+v\n", logGroupName, err)
+			}
+		}
+		result.Transports = append(result.Transports, transportResult)
 	}
 
-	return nil
+	if request.Report {
+		location, err := writeHTMLReport(ctx, request, result)
+		if err != nil {
+			fmt.Printf("failed to write report of analysis %s: %+v\n", cp.AnalysisId, err)
+		} else {
+			fmt.Printf("wrote report of analysis %s to %s\n", cp.AnalysisId, location)
+			result.Report = location
+		}
+	}
+
+	result.MetricsErrors = exportMetrics(ctx, request, result)
+
+	// Nobody is waiting for the result of a resumed analysis, so it is stored next to the checkpoint.
+	if cp.Invocations > 0 {
+		if err := putJSON(ctx, resultKey(cp.AnalysisId), result); err != nil {
+			return result, err
+		}
+		if err := deleteCheckpoint(ctx, cp.AnalysisId); err != nil {
+			fmt.Printf("failed to delete checkpoint of analysis %s: %+v\n", cp.AnalysisId, err)
+		}
+		fmt.Printf("stored result of analysis %s in s3://%s/%s\n", cp.AnalysisId, resultsBucket, resultKey(cp.AnalysisId))
+	}
+	return result, nil
+}
+
+// handleCompare compares the two runs of a compare request. Unlike an analysis, a comparison is not
+// checkpointed, it must complete within a single invocation.
+func handleCompare(ctx context.Context, analysisId string, request AnalyzeRequest) (AnalyzeResult, error) {
+	comparison, err := compareRuns(ctx, request)
+	if err != nil {
+		return AnalyzeResult{}, err
+	}
+	printCompareResult(comparison)
+	return AnalyzeResult{
+		AnalysisId: analysisId,
+		Status:     statusComplete,
+		StartTime:  *request.StartTime,
+		EndTime:    *request.EndTime,
+		Comparison: comparison,
+	}, nil
+}
+
+// analysisId identifies an analysis across the invocations it is spread over, by the request ID of
+// the invocation that started it.
+func analysisId(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return lc.AwsRequestID
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
 }
 
 func main() {
 	fmt.Printf("init start\n")
 
 	region = os.Getenv("REGION")
-	queueLogGroupName = os.Getenv("QUEUE_CLOUDWATCH_LOGS_LOG_GROUP")
-	streamLogGroupName = os.Getenv("STREAM_CLOUDWATCH_LOGS_LOG_GROUP")
+	// Each transport is analyzed from the log group of its consumer function. Consumer functions
+	// discovered in the stack are added to these on the first invocation.
+	stackName = os.Getenv("STACK_NAME")
+	logGroupNames = make(map[string]string)
+	if value := os.Getenv("QUEUE_CLOUDWATCH_LOGS_LOG_GROUP"); value != "" {
+		logGroupNames["queue"] = value
+	}
+	if value := os.Getenv("STREAM_CLOUDWATCH_LOGS_LOG_GROUP"); value != "" {
+		logGroupNames["stream"] = value
+	}
+	// The queue and stream of each transport, for their service metrics.
+	if value := os.Getenv("QUEUE_NAME"); value != "" {
+		serviceMetricsResources["queue"] = transportResources{QueueName: value}
+	}
+	if value := os.Getenv("STREAM_NAME"); value != "" {
+		serviceMetricsResources["stream"] = transportResources{StreamName: value, ConsumerName: os.Getenv("STREAM_CONSUMER_NAME")}
+	}
+	if value := os.Getenv("CONSUMER_TIMEOUT"); value != "" {
+		var err error
+		if consumerTimeout, err = time.ParseDuration(value); err != nil {
+			panic(fmt.Errorf("failed to parse CONSUMER_TIMEOUT, %w", err))
+		}
+	}
+	if value := os.Getenv("STREAM_SHARD_COUNT"); value != "" {
+		var err error
+		if streamShardCount, err = strconv.Atoi(value); err != nil {
+			panic(fmt.Errorf("failed to parse STREAM_SHARD_COUNT, %w", err))
+		}
+	}
+	resultsBucket = os.Getenv("RESULTS_BUCKET")
+	defaultBackend = os.Getenv("ANALYZER_BACKEND")
+	if defaultBackend == "" {
+		defaultBackend = backendInsights
+	}
+	if value := os.Getenv("PRICE_TABLE"); value != "" {
+		var err error
+		if priceTable, err = loadPriceTable(value); err != nil {
+			panic(err)
+		}
+	}
+	openMetricsEndpoint = os.Getenv("OPENMETRICS_ENDPOINT")
+	influxEndpoint = os.Getenv("INFLUX_ENDPOINT")
+	influxToken = os.Getenv("INFLUX_TOKEN")
+	if value := os.Getenv("GROUP_BY"); value != "" {
+		groupBy = strings.Split(value, ",")
+		for _, dimension := range groupBy {
+			if _, ok := dimensions[dimension]; !ok {
+				panic(fmt.Sprintf("unknown GROUP_BY dimension %s", dimension))
+			}
+		}
+	}
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion(region),
@@ -120,7 +834,21 @@ func main() {
 	cloudformationClient = cloudformation.NewFromConfig(cfg, func(o *cloudformation.Options) {
 	})
 
+	s3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+	})
+
+	lambdaClient = awslambda.NewFromConfig(cfg, func(o *awslambda.Options) {
+	})
+
+	cloudwatchClient = cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) {
+	})
+
 	fmt.Printf("init finished\n")
 
+	// Outside of Lambda, the analyzer runs once as a CLI.
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		runCLI()
+		return
+	}
 	lambda.Start(handler)
 }
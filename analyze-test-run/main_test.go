@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResolveRequestBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", request: `{}`, want: backendInsights},
+		{name: "group by", request: `{"group_by":["shard_id"]}`, want: backendFilter},
+		{name: "time series", request: `{"bucket_width":"10s"}`, want: backendFilter},
+		{name: "steady state", request: `{"steady_state":true}`, want: backendFilter},
+		{name: "shape", request: `{"shape":true}`, want: backendFilter},
+		{name: "explicit filter", request: `{"backend":"filter"}`, want: backendFilter},
+		{name: "explicit insights", request: `{"backend":"insights"}`, want: backendInsights},
+		{name: "explicit insights with shape", request: `{"backend":"insights","shape":true}`, wantErr: true},
+		{name: "scenario", request: `{"scenario":"nightly"}`, want: backendFilter},
+		{name: "explicit insights with scenario", request: `{"backend":"insights","scenario":"nightly"}`, wantErr: true},
+		{name: "promote", request: `{"scenario":"nightly","promote":"run"}`, want: backendInsights},
+	}
+	defer func(previous string) { defaultBackend = previous }(defaultBackend)
+	defaultBackend = backendInsights
+	defer func(previous string) { resultsBucket = previous }(resultsBucket)
+	resultsBucket = "results"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var request AnalyzeRequest
+			if err := json.Unmarshal([]byte(test.request), &request); err != nil {
+				t.Fatal(err)
+			}
+
+			resolved, err := resolveRequest(request)
+
+			// Analyses only FilterLogEvents provides are not left to Logs Insights.
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got backend %s", resolved.Backend)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved.Backend != test.want {
+				t.Errorf("expected backend %s, got %s", test.want, resolved.Backend)
+			}
+		})
+	}
+}
+
+func TestResolveRequestRegressionThreshold(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    float64
+		wantErr bool
+	}{
+		{name: "default", request: `{}`, want: defaultRegressionThreshold},
+		{name: "any regression", request: `{"regression_threshold":0}`, want: 0},
+		{name: "explicit", request: `{"regression_threshold":0.25}`, want: 0.25},
+		{name: "negative", request: `{"regression_threshold":-0.1}`, wantErr: true},
+		{name: "negative percentile", request: `{"thresholds":{"p99":-0.1}}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := AnalyzeRequest{Backend: backendFilter}
+			if err := json.Unmarshal([]byte(test.request), &request); err != nil {
+				t.Fatal(err)
+			}
+
+			resolved, err := resolveRequest(request)
+
+			// An explicit threshold is kept, even 0, and only a missing one is defaulted.
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got a threshold of %g", *resolved.RegressionThreshold)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := *resolved.RegressionThreshold; got != test.want {
+				t.Errorf("expected a threshold of %g, got %g", test.want, got)
+			}
+		})
+	}
+}
+
+func TestResolveRequestSignificantFigures(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    int
+		wantErr bool
+	}{
+		{name: "default", request: `{}`, want: 3},
+		{name: "lowest", request: `{"significant_figures":1}`, want: 1},
+		{name: "highest", request: `{"significant_figures":3}`, want: 3},
+		{name: "above the highest", request: `{"significant_figures":4}`, wantErr: true},
+		{name: "top of the HDR range", request: `{"significant_figures":5}`, wantErr: true},
+		{name: "negative", request: `{"significant_figures":-1}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := AnalyzeRequest{Backend: backendFilter}
+			if err := json.Unmarshal([]byte(test.request), &request); err != nil {
+				t.Fatal(err)
+			}
+
+			resolved, err := resolveRequest(request)
+
+			// Only precisions whose histograms fit in the analyzer's memory are accepted.
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d significant figures", resolved.SignificantFigures)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved.SignificantFigures != test.want {
+				t.Errorf("expected %d significant figures, got %d", test.want, resolved.SignificantFigures)
+			}
+			if size := newHdrAggregator(resolved.SignificantFigures).histogram.ByteSize(); size > 256*1024 {
+				t.Errorf("expected a histogram of at most 256 KB, got %d bytes", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	influxContentType      = "text/plain; charset=utf-8"
+)
+
+// metricsClient pushes run summaries to the metrics endpoints.
+var metricsClient = &http.Client{Timeout: 30 * time.Second}
+
+// label is a Prometheus label or InfluxDB tag. Labels are kept in order so that the output is stable.
+type label struct {
+	name  string
+	value string
+}
+
+// metricsRun is a run with the transport it was measured on.
+type metricsRun struct {
+	transport string
+	run       RunResult
+}
+
+// metricsDistribution is one distribution of a run, e.g. its cold deliveries, as exported by
+// exportTransport.
+type metricsDistribution struct {
+	name    string
+	summary LatencySummary
+}
+
+func (r metricsRun) distributions() []metricsDistribution {
+	distributions := []metricsDistribution{{"all", r.run.All}, {"cold", r.run.Cold}, {"warm", r.run.Warm}}
+	if r.run.SteadyState != nil {
+		distributions = append(distributions, metricsDistribution{"steady_state", r.run.SteadyState.Latency})
+	}
+	return distributions
+}
+
+// labels identifies the configuration of a run on the dashboards. The memory size and batch size are
+// those observed in the deliveries of the run; labels without a value are left out. The test run id is
+// not a label, as every run would start new series.
+func (r metricsRun) labels(scenario string) []label {
+	labels := []label{
+		{"transport", r.transport},
+		{"scenario", scenario},
+	}
+	if r.run.FunctionMemorySize > 0 {
+		labels = append(labels, label{"memory_size", strconv.Itoa(r.run.FunctionMemorySize)})
+	}
+	if r.run.MaxBatchSize > 0 {
+		labels = append(labels, label{"batch_size", strconv.Itoa(r.run.MaxBatchSize)})
+	}
+	var set []label
+	for _, l := range labels {
+		if l.value != "" {
+			set = append(set, l)
+		}
+	}
+	return set
+}
+
+func metricsRuns(result AnalyzeResult) []metricsRun {
+	var runs []metricsRun
+	for _, transport := range result.Transports {
+		for _, run := range transport.Runs {
+			runs = append(runs, metricsRun{transport.Transport, run})
+		}
+	}
+	return runs
+}
+
+// latestMetricsRuns keeps the last run to be received of each set of labels, as OpenMetrics allows a
+// single sample per series.
+func latestMetricsRuns(runs []metricsRun, scenario string) []metricsRun {
+	var latest []metricsRun
+	index := make(map[string]int)
+	for _, run := range runs {
+		key := openMetricsLabels(run.labels(scenario))
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(latest)
+			latest = append(latest, run)
+		} else if run.run.LastReceived.After(latest[i].run.LastReceived) {
+			latest[i] = run
+		}
+	}
+	return latest
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func openMetricsLabels(labels []label) string {
+	formatted := make([]string, len(labels))
+	for i, l := range labels {
+		formatted[i] = l.name + `="` + openMetricsEscaper.Replace(l.value) + `"`
+	}
+	return "{" + strings.Join(formatted, ",") + "}"
+}
+
+// writeOpenMetrics writes the summaries of the runs of a result in the OpenMetrics text format. The
+// latency of each distribution is a summary, with its percentiles as quantiles; the minimum and
+// maximum are kept as the 0 and 1 quantiles. Every sample of a family is written together, as the
+// format requires. Of runs with the same labels, only the last one is written, see latestMetricsRuns.
+func writeOpenMetrics(w io.Writer, scenario string, result AnalyzeResult) error {
+	runs := latestMetricsRuns(metricsRuns(result), scenario)
+	var out bytes.Buffer
+
+	out.WriteString("# TYPE benchmark_latency_milliseconds summary\n")
+	out.WriteString("# UNIT benchmark_latency_milliseconds milliseconds\n")
+	out.WriteString("# HELP benchmark_latency_milliseconds Delivery latency from send to receive.\n")
+	for _, run := range runs {
+		for _, distribution := range run.distributions() {
+			if distribution.summary.Count == 0 {
+				continue
+			}
+			labels := append(run.labels(scenario), label{"distribution", distribution.name})
+			for _, percentile := range distribution.summary.Percentiles {
+				quantileLabels := append(append([]label(nil), labels...), label{"quantile", formatMetricValue(percentile.Quantile)})
+				fmt.Fprintf(&out, "benchmark_latency_milliseconds%s %s\n", openMetricsLabels(quantileLabels), formatMetricValue(percentile.Value))
+			}
+			fmt.Fprintf(&out, "benchmark_latency_milliseconds_sum%s %s\n", openMetricsLabels(labels), formatMetricValue(distribution.summary.Mean*float64(distribution.summary.Count)))
+			fmt.Fprintf(&out, "benchmark_latency_milliseconds_count%s %d\n", openMetricsLabels(labels), distribution.summary.Count)
+		}
+	}
+
+	gauges := []struct {
+		name  string
+		unit  string
+		help  string
+		value func(RunResult) float64
+	}{
+		{"benchmark_throughput_messages_per_second", "", "Messages received per second between the first and last receive.", func(run RunResult) float64 { return run.Throughput }},
+		{"benchmark_duration_seconds", "seconds", "Time between the first and last receive.", func(run RunResult) float64 { return run.DurationSeconds }},
+		{"benchmark_cold_starts", "", "Invocations of the consumer that were cold starts.", func(run RunResult) float64 { return float64(run.ColdStarts) }},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(&out, "# TYPE %s gauge\n", gauge.name)
+		if gauge.unit != "" {
+			fmt.Fprintf(&out, "# UNIT %s %s\n", gauge.name, gauge.unit)
+		}
+		fmt.Fprintf(&out, "# HELP %s %s\n", gauge.name, gauge.help)
+		for _, run := range runs {
+			fmt.Fprintf(&out, "%s%s %s\n", gauge.name, openMetricsLabels(run.labels(scenario)), formatMetricValue(gauge.value(run.run)))
+		}
+	}
+	out.WriteString("# EOF\n")
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// influxEscaper escapes tag keys, tag values and field keys.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxStringEscaper escapes string field values.
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func influxString(value string) string {
+	return `"` + influxStringEscaper.Replace(value) + `"`
+}
+
+func influxTags(labels []label) string {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	var tags strings.Builder
+	for _, l := range labels {
+		tags.WriteString("," + influxEscaper.Replace(l.name) + "=" + influxEscaper.Replace(l.value))
+	}
+	return tags.String()
+}
+
+// writeInfluxLines writes the summaries of the runs of a result in InfluxDB line protocol, one point
+// per distribution in benchmark_latency and one per run in benchmark_run. Points are stamped with the
+// last receive of their run, or the end of the analysis for Logs Insights results without one. The test
+// run id is a field rather than a tag, so that runs do not each start a new series.
+func writeInfluxLines(w io.Writer, scenario string, result AnalyzeResult) error {
+	var out bytes.Buffer
+	for _, run := range metricsRuns(result) {
+		timestamp := run.run.LastReceived
+		if timestamp.IsZero() {
+			timestamp = result.EndTime
+		}
+		for _, distribution := range run.distributions() {
+			if distribution.summary.Count == 0 {
+				continue
+			}
+			labels := append(run.labels(scenario), label{"distribution", distribution.name})
+			fields := []string{
+				"test_run_id=" + influxString(run.run.TestRunId),
+				"count=" + strconv.FormatUint(distribution.summary.Count, 10) + "i",
+				"mean=" + formatMetricValue(distribution.summary.Mean),
+				"stddev=" + formatMetricValue(distribution.summary.StdDev),
+			}
+			for _, percentile := range distribution.summary.Percentiles {
+				fields = append(fields, influxEscaper.Replace(percentileName(percentile.Quantile))+"="+formatMetricValue(percentile.Value))
+			}
+			fmt.Fprintf(&out, "benchmark_latency%s %s %d\n", influxTags(labels), strings.Join(fields, ","), timestamp.UnixNano())
+		}
+		fmt.Fprintf(&out, "benchmark_run%s test_run_id=%s,throughput=%s,duration_seconds=%s,cold_starts=%di %d\n",
+			influxTags(run.labels(scenario)), influxString(run.run.TestRunId), formatMetricValue(run.run.Throughput), formatMetricValue(run.run.DurationSeconds),
+			run.run.ColdStarts, timestamp.UnixNano())
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// pushMetrics sends a body of metrics to an endpoint with a POST, and fails on any status but 2xx,
+// with the status and the start of the response body, which tells why the endpoint rejected it.
+func pushMetrics(ctx context.Context, endpoint string, contentType string, body []byte, header http.Header) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request to %s, %w", endpoint, err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", contentType)
+	response, err := metricsClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics to %s, %w", endpoint, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("failed to push metrics to %s, status %s: %s", endpoint, response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// pushOpenMetrics pushes the run summaries of a result to a Pushgateway-compatible endpoint, e.g.
+// http://pushgateway:9091/metrics/job/event-benchmark. A POST replaces only the metrics of the same
+// names within the group of the URL.
+func pushOpenMetrics(ctx context.Context, endpoint string, scenario string, result AnalyzeResult) error {
+	var body bytes.Buffer
+	if err := writeOpenMetrics(&body, scenario, result); err != nil {
+		return err
+	}
+	return pushMetrics(ctx, endpoint, openMetricsContentType, body.Bytes(), nil)
+}
+
+// pushInfluxLines writes the run summaries of a result to an InfluxDB write endpoint, e.g.
+// http://influxdb:8086/api/v2/write?org=benchmark&bucket=runs&precision=ns. The token, if any, is
+// sent as an InfluxDB API token.
+func pushInfluxLines(ctx context.Context, endpoint string, token string, scenario string, result AnalyzeResult) error {
+	var body bytes.Buffer
+	if err := writeInfluxLines(&body, scenario, result); err != nil {
+		return err
+	}
+	header := make(http.Header)
+	if token != "" {
+		header.Set("Authorization", "Token "+token)
+	}
+	return pushMetrics(ctx, endpoint, influxContentType, body.Bytes(), header)
+}
+
+// exportMetrics pushes the run summaries of a complete analysis to the configured metrics endpoints.
+// Failures do not fail the analysis, they are returned to be reported in its result instead.
+func exportMetrics(ctx context.Context, request AnalyzeRequest, result AnalyzeResult) []string {
+	var failures []string
+	if openMetricsEndpoint != "" {
+		if err := pushOpenMetrics(ctx, openMetricsEndpoint, request.Scenario, result); err != nil {
+			fmt.Printf("failed to push metrics of analysis %s: %+v\n", result.AnalysisId, err)
+			failures = append(failures, err.Error())
+		} else {
+			fmt.Printf("pushed metrics of analysis %s to %s\n", result.AnalysisId, openMetricsEndpoint)
+		}
+	}
+	if influxEndpoint != "" {
+		if err := pushInfluxLines(ctx, influxEndpoint, influxToken, request.Scenario, result); err != nil {
+			fmt.Printf("failed to write points of analysis %s: %+v\n", result.AnalysisId, err)
+			failures = append(failures, err.Error())
+		} else {
+			fmt.Printf("wrote points of analysis %s to %s\n", result.AnalysisId, influxEndpoint)
+		}
+	}
+	return failures
+}
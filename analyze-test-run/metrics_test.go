@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricsStub records the requests pushed to it, and answers them with a status and a body.
+type metricsStub struct {
+	server   *httptest.Server
+	status   int
+	response string
+	method   string
+	path     string
+	header   http.Header
+	body     string
+}
+
+func newMetricsStub(t *testing.T, status int) *metricsStub {
+	stub := &metricsStub{status: status}
+	stub.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		stub.method, stub.path, stub.header, stub.body = r.Method, r.URL.RequestURI(), r.Header, string(body)
+		w.WriteHeader(stub.status)
+		_, _ = io.WriteString(w, stub.response)
+	}))
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func metricsResult() AnalyzeResult {
+	lastReceived := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return AnalyzeResult{
+		AnalysisId: "analysis",
+		EndTime:    lastReceived.Add(time.Hour),
+		Transports: []TransportResult{{
+			Transport: "queue",
+			Runs: []RunResult{{
+				TestRunId:  "run 1",
+				ColdStarts: 2,
+				All: LatencySummary{Count: 10, Mean: 20, StdDev: 5, Percentiles: []Percentile{
+					{Quantile: 0.5, Value: 18},
+					{Quantile: 0.99, Value: 42.5},
+				}},
+				Cold:               LatencySummary{Count: 2, Mean: 40, Percentiles: []Percentile{{Quantile: 0.5, Value: 40}}},
+				Warm:               LatencySummary{Count: 8, Mean: 15, Percentiles: []Percentile{{Quantile: 0.5, Value: 15}}},
+				FunctionMemorySize: 256,
+				MaxBatchSize:       10,
+				LastReceived:       lastReceived,
+				DurationSeconds:    4,
+				Throughput:         2.5,
+			}},
+		}},
+	}
+}
+
+func TestPushOpenMetrics(t *testing.T) {
+	stub := newMetricsStub(t, http.StatusOK)
+
+	err := pushOpenMetrics(context.Background(), stub.server.URL+"/metrics/job/event-benchmark", "baseline", metricsResult())
+
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if stub.method != http.MethodPost || stub.path != "/metrics/job/event-benchmark" {
+		t.Errorf("pushed with %s %s", stub.method, stub.path)
+	}
+	if contentType := stub.header.Get("Content-Type"); contentType != openMetricsContentType {
+		t.Errorf("pushed with content type %s", contentType)
+	}
+	labels := `transport="queue",scenario="baseline",memory_size="256",batch_size="10"`
+	for _, line := range []string{
+		"# TYPE benchmark_latency_milliseconds summary",
+		`benchmark_latency_milliseconds{` + labels + `,distribution="all",quantile="0.99"} 42.5`,
+		`benchmark_latency_milliseconds_sum{` + labels + `,distribution="all"} 200`,
+		`benchmark_latency_milliseconds_count{` + labels + `,distribution="cold"} 2`,
+		`benchmark_throughput_messages_per_second{` + labels + `} 2.5`,
+		`benchmark_cold_starts{` + labels + `} 2`,
+	} {
+		if !strings.Contains(stub.body, line+"\n") {
+			t.Errorf("pushed body lacks %q:\n%s", line, stub.body)
+		}
+	}
+	if !strings.HasSuffix(stub.body, "# EOF\n") {
+		t.Errorf("pushed body does not end with # EOF:\n%s", stub.body)
+	}
+}
+
+func TestWriteOpenMetricsLatestRun(t *testing.T) {
+	// Two runs of the same configuration, the second received later and with a higher throughput.
+	result := metricsResult()
+	later := result.Transports[0].Runs[0]
+	later.TestRunId = "run 2"
+	later.LastReceived = later.LastReceived.Add(time.Minute)
+	later.Throughput = 5
+	result.Transports[0].Runs = append(result.Transports[0].Runs, later)
+
+	var body strings.Builder
+	if err := writeOpenMetrics(&body, "baseline", result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the later run is written, without its test run id.
+	throughput := `benchmark_throughput_messages_per_second{transport="queue",scenario="baseline",memory_size="256",batch_size="10"}`
+	if got := strings.Count(body.String(), throughput); got != 1 {
+		t.Errorf("expected a single throughput sample, got %d:\n%s", got, body.String())
+	}
+	if !strings.Contains(body.String(), throughput+" 5\n") {
+		t.Errorf("expected the throughput of the later run:\n%s", body.String())
+	}
+	if strings.Contains(body.String(), "test_run_id") {
+		t.Errorf("expected no test run id label:\n%s", body.String())
+	}
+}
+
+func TestPushInfluxLines(t *testing.T) {
+	stub := newMetricsStub(t, http.StatusNoContent)
+
+	err := pushInfluxLines(context.Background(), stub.server.URL+"/api/v2/write?bucket=runs", "secret", "", metricsResult())
+
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if authorization := stub.header.Get("Authorization"); authorization != "Token secret" {
+		t.Errorf("pushed with authorization %s", authorization)
+	}
+	if stub.path != "/api/v2/write?bucket=runs" {
+		t.Errorf("pushed to %s", stub.path)
+	}
+	timestamp := " 1714564800000000000\n"
+	for _, line := range []string{
+		`benchmark_latency,batch_size=10,distribution=all,memory_size=256,transport=queue test_run_id="run 1",count=10i,mean=20,stddev=5,p50=18,p99=42.5` + timestamp,
+		`benchmark_run,batch_size=10,memory_size=256,transport=queue test_run_id="run 1",throughput=2.5,duration_seconds=4,cold_starts=2i` + timestamp,
+	} {
+		if !strings.Contains(stub.body, line) {
+			t.Errorf("pushed body lacks %q:\n%s", line, stub.body)
+		}
+	}
+}
+
+func TestPushMetricsFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		push func(endpoint string) error
+	}{
+		{
+			name: "openmetrics",
+			push: func(endpoint string) error {
+				return pushOpenMetrics(context.Background(), endpoint, "baseline", metricsResult())
+			},
+		},
+		{
+			name: "influx",
+			push: func(endpoint string) error {
+				return pushInfluxLines(context.Background(), endpoint, "", "baseline", metricsResult())
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newMetricsStub(t, http.StatusBadRequest)
+			stub.response = "text format parsing error in line 3\n"
+			err := test.push(stub.server.URL)
+			if err == nil || !strings.Contains(err.Error(), "400 Bad Request") || !strings.Contains(err.Error(), "text format parsing error in line 3") {
+				t.Errorf("expected the status and body in the error, got %v", err)
+			}
+			if stub.header.Get("Authorization") != "" {
+				t.Errorf("pushed with authorization without a token")
+			}
+		})
+	}
+}
+
+func TestExportMetricsReportsFailures(t *testing.T) {
+	defer func(openMetrics string, influx string) {
+		openMetricsEndpoint, influxEndpoint = openMetrics, influx
+	}(openMetricsEndpoint, influxEndpoint)
+	rejecting := newMetricsStub(t, http.StatusNotFound)
+	rejecting.response = "404 page not found"
+	accepting := newMetricsStub(t, http.StatusNoContent)
+	openMetricsEndpoint, influxEndpoint = rejecting.server.URL+"/metrics", accepting.server.URL
+
+	failures := exportMetrics(context.Background(), AnalyzeRequest{}, metricsResult())
+	if len(failures) != 1 || !strings.Contains(failures[0], "404 Not Found: 404 page not found") {
+		t.Errorf("expected the rejected push to be reported, got %v", failures)
+	}
+}
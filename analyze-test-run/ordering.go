@@ -0,0 +1,316 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// orderingWindow is how long a delivery is held back behind the latest handler start time seen
+	// before its order is checked. Log events do not arrive in delivery order, e.g. from different log
+	// streams, so holding them back lets them be checked in delivery order. Partitions idle for longer
+	// than the window are forgotten.
+	orderingWindow = 30 * time.Second
+	// orderingEvictEvery is the number of checked deliveries between looking for idle partitions.
+	orderingEvictEvery = 1000
+	// maxReportedPartitions is the number of partitions with out-of-order deliveries that are listed,
+	// the ones with the most.
+	maxReportedPartitions = 20
+	// maxMessageNumber bounds the message numbers checked for duplicates, and with it the size of the
+	// bitmaps of delivered messages to 32 MiB each.
+	maxMessageNumber = 1 << 28
+)
+
+// delivery is a single successful handling of a message, as far as ordering is concerned.
+type delivery struct {
+	PartitionKey     string    `json:"partition_key"`
+	MessageNumber    int       `json:"message_number"`
+	HandlerStartTime time.Time `json:"handler_start_time"`
+	BatchIndex       int       `json:"batch_index"`
+}
+
+// pendingDeliveries is a min-heap of the deliveries held back, by handler start time and position in
+// the batch.
+type pendingDeliveries []delivery
+
+func (h pendingDeliveries) Len() int { return len(h) }
+func (h pendingDeliveries) Less(i, j int) bool {
+	if !h[i].HandlerStartTime.Equal(h[j].HandlerStartTime) {
+		return h[i].HandlerStartTime.Before(h[j].HandlerStartTime)
+	}
+	return h[i].BatchIndex < h[j].BatchIndex
+}
+func (h pendingDeliveries) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pendingDeliveries) Push(x interface{}) { *h = append(*h, x.(delivery)) }
+func (h *pendingDeliveries) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// bitmap is a set of message numbers.
+type bitmap []byte
+
+// add adds a message number to the set, and reports whether it was already in it.
+func (b *bitmap) add(n int) bool {
+	i, mask := n/8, byte(1)<<(n%8)
+	if i >= len(*b) {
+		grown := make([]byte, i+1+i/2)
+		copy(grown, *b)
+		*b = grown
+	}
+	present := (*b)[i]&mask != 0
+	(*b)[i] |= mask
+	return present
+}
+
+// partitionState is what is remembered of a partition between its deliveries.
+type partitionState struct {
+	Highest            int       `json:"highest"`
+	LastSeen           time.Time `json:"last_seen"`
+	Deliveries         int       `json:"deliveries"`
+	OutOfOrder         int       `json:"out_of_order"`
+	MaxReorderDistance int       `json:"max_reorder_distance"`
+}
+
+// orderingCheck verifies ordering and duplicate delivery as deliveries are seen, in memory bounded by
+// the deliveries and partitions of the last orderingWindow rather than by the size of the run.
+// Ordering is only checked where the transport guarantees it: within a Kinesis partition key or a
+// FIFO message group. Deliveries from standard queues have no partition key and are only checked
+// for duplicates.
+//
+// The stream producer uses the batch number as the partition key, so each partition key holds the
+// records of a single PutRecords batch, in the order of the batch. The check therefore assumes that
+// Kinesis keeps the records of one PutRecords request in request order, as it does in practice for
+// records of the same partition key, although PutRecords does not guarantee it. An out-of-order
+// delivery can be the stream reordering a request rather than the consumer. The records of a batch
+// are handled within seconds of each other, well inside orderingWindow, unless the batch is retried
+// after a failure: a retry that starts more than orderingWindow after the partition was last seen
+// finds it forgotten, and its order is checked as if it were a new partition.
+type orderingCheck struct {
+	pending              pendingDeliveries
+	latest               time.Time
+	partitions           map[string]*partitionState
+	reported             []PartitionOrdering
+	checked              int
+	outOfOrder           int
+	totalReorderDistance int
+	maxReorderDistance   int
+	delivered            bitmap
+	duplicated           bitmap
+	duplicatedMessages   int
+	duplicateDeliveries  int
+	unordered            int
+}
+
+// orderingState is the serialized form of an orderingCheck.
+type orderingState struct {
+	Pending              []delivery                 `json:"pending"`
+	Latest               time.Time                  `json:"latest"`
+	Partitions           map[string]*partitionState `json:"partitions"`
+	Reported             []PartitionOrdering        `json:"reported"`
+	OutOfOrder           int                        `json:"out_of_order"`
+	TotalReorderDistance int                        `json:"total_reorder_distance"`
+	MaxReorderDistance   int                        `json:"max_reorder_distance"`
+	Delivered            []byte                     `json:"delivered"`
+	Duplicated           []byte                     `json:"duplicated"`
+	DuplicatedMessages   int                        `json:"duplicated_messages"`
+	DuplicateDeliveries  int                        `json:"duplicate_deliveries"`
+	Unordered            int                        `json:"unordered"`
+}
+
+// PartitionOrdering summarizes ordering violations for a single partition key.
+type PartitionOrdering struct {
+	PartitionKey       string `json:"partition_key"`
+	Deliveries         int    `json:"deliveries"`
+	OutOfOrder         int    `json:"out_of_order"`
+	MaxReorderDistance int    `json:"max_reorder_distance"`
+}
+
+// OrderingResult summarizes the ordering and duplicate delivery checks of a single run. Partitions
+// lists the partition keys with the most out-of-order deliveries, at most maxReportedPartitions.
+type OrderingResult struct {
+	Partitions []PartitionOrdering `json:"partitions"`
+	OutOfOrder int                 `json:"out_of_order"`
+	// MeanReorderDistance and MaxReorderDistance are measured in message numbers, between an
+	// out-of-order message and the highest message number delivered before it on its partition key.
+	MeanReorderDistance float64 `json:"mean_reorder_distance"`
+	MaxReorderDistance  int     `json:"max_reorder_distance"`
+	// DuplicatedMessages is the number of messages delivered more than once, DuplicateDeliveries the
+	// number of deliveries beyond the first.
+	DuplicatedMessages  int `json:"duplicated_messages"`
+	DuplicateDeliveries int `json:"duplicate_deliveries"`
+	// Unordered is the number of deliveries without an ordering guarantee, whose order is not checked.
+	Unordered int `json:"unordered"`
+}
+
+func newOrderingCheck() *orderingCheck {
+	return &orderingCheck{partitions: make(map[string]*partitionState)}
+}
+
+func (c *orderingCheck) add(output Output) {
+	if output.PartitionKey == "" {
+		c.unordered++
+	}
+	if output.MessageNumber >= 0 && output.MessageNumber < maxMessageNumber && c.delivered.add(output.MessageNumber) {
+		// A redelivery is a duplicate, not a reordering.
+		c.duplicateDeliveries++
+		if !c.duplicated.add(output.MessageNumber) {
+			c.duplicatedMessages++
+		}
+		return
+	}
+	if output.PartitionKey == "" {
+		return
+	}
+	handlerStartTime, _ := time.Parse(time.RFC3339Nano, output.HandlerStartTime)
+	heap.Push(&c.pending, delivery{
+		PartitionKey:     output.PartitionKey,
+		MessageNumber:    output.MessageNumber,
+		HandlerStartTime: handlerStartTime,
+		BatchIndex:       output.BatchIndex,
+	})
+	if handlerStartTime.After(c.latest) {
+		c.latest = handlerStartTime
+	}
+	c.drain(c.latest.Add(-orderingWindow))
+}
+
+// drain checks the order of the deliveries held back that started before a time.
+func (c *orderingCheck) drain(before time.Time) {
+	for len(c.pending) > 0 && c.pending[0].HandlerStartTime.Before(before) {
+		c.check(heap.Pop(&c.pending).(delivery))
+	}
+}
+
+func (c *orderingCheck) check(d delivery) {
+	partition, ok := c.partitions[d.PartitionKey]
+	if !ok {
+		partition = &partitionState{Highest: -1}
+		c.partitions[d.PartitionKey] = partition
+	}
+	partition.Deliveries++
+	partition.LastSeen = d.HandlerStartTime
+	if d.MessageNumber < partition.Highest {
+		distance := partition.Highest - d.MessageNumber
+		partition.OutOfOrder++
+		c.outOfOrder++
+		c.totalReorderDistance += distance
+		if distance > partition.MaxReorderDistance {
+			partition.MaxReorderDistance = distance
+		}
+		if distance > c.maxReorderDistance {
+			c.maxReorderDistance = distance
+		}
+	} else {
+		partition.Highest = d.MessageNumber
+	}
+	c.checked++
+	if c.checked%orderingEvictEvery == 0 {
+		c.evict(d.HandlerStartTime.Add(-orderingWindow))
+	}
+}
+
+// evict forgets the partitions last seen before a time, keeping the summary of those with the most
+// out-of-order deliveries.
+func (c *orderingCheck) evict(before time.Time) {
+	for partitionKey, partition := range c.partitions {
+		if !partition.LastSeen.Before(before) {
+			continue
+		}
+		delete(c.partitions, partitionKey)
+		if partition.OutOfOrder == 0 {
+			continue
+		}
+		c.reported = append(c.reported, PartitionOrdering{
+			PartitionKey:       partitionKey,
+			Deliveries:         partition.Deliveries,
+			OutOfOrder:         partition.OutOfOrder,
+			MaxReorderDistance: partition.MaxReorderDistance,
+		})
+	}
+	sort.Slice(c.reported, func(i, j int) bool {
+		if c.reported[i].OutOfOrder != c.reported[j].OutOfOrder {
+			return c.reported[i].OutOfOrder > c.reported[j].OutOfOrder
+		}
+		return c.reported[i].PartitionKey < c.reported[j].PartitionKey
+	})
+	if len(c.reported) > maxReportedPartitions {
+		c.reported = c.reported[:maxReportedPartitions]
+	}
+}
+
+// result checks the deliveries still held back, so it is only called once every delivery of the run
+// has been seen.
+func (c *orderingCheck) result() *OrderingResult {
+	c.drain(c.latest.Add(time.Nanosecond))
+	c.evict(c.latest.Add(time.Nanosecond))
+	result := &OrderingResult{
+		Partitions:          append([]PartitionOrdering(nil), c.reported...),
+		OutOfOrder:          c.outOfOrder,
+		MaxReorderDistance:  c.maxReorderDistance,
+		DuplicatedMessages:  c.duplicatedMessages,
+		DuplicateDeliveries: c.duplicateDeliveries,
+		Unordered:           c.unordered,
+	}
+	if c.outOfOrder > 0 {
+		result.MeanReorderDistance = float64(c.totalReorderDistance) / float64(c.outOfOrder)
+	}
+	sort.Slice(result.Partitions, func(i, j int) bool {
+		return result.Partitions[i].PartitionKey < result.Partitions[j].PartitionKey
+	})
+	return result
+}
+
+func (c *orderingCheck) state() orderingState {
+	return orderingState{
+		Pending:              c.pending,
+		Latest:               c.latest,
+		Partitions:           c.partitions,
+		Reported:             c.reported,
+		OutOfOrder:           c.outOfOrder,
+		TotalReorderDistance: c.totalReorderDistance,
+		MaxReorderDistance:   c.maxReorderDistance,
+		Delivered:            c.delivered,
+		Duplicated:           c.duplicated,
+		DuplicatedMessages:   c.duplicatedMessages,
+		DuplicateDeliveries:  c.duplicateDeliveries,
+		Unordered:            c.unordered,
+	}
+}
+
+func (c *orderingCheck) restore(state orderingState) {
+	c.pending = state.Pending
+	heap.Init(&c.pending)
+	c.latest = state.Latest
+	if state.Partitions != nil {
+		c.partitions = state.Partitions
+	}
+	c.reported = state.Reported
+	c.outOfOrder = state.OutOfOrder
+	c.totalReorderDistance = state.TotalReorderDistance
+	c.maxReorderDistance = state.MaxReorderDistance
+	c.delivered = state.Delivered
+	c.duplicated = state.Duplicated
+	c.duplicatedMessages = state.DuplicatedMessages
+	c.duplicateDeliveries = state.DuplicateDeliveries
+	c.unordered = state.Unordered
+}
+
+func printOrdering(testRunId string, result OrderingResult) {
+	if result.Unordered > 0 {
+		fmt.Printf("testRunId %s, order of %d deliveries not checked, standard queues do not guarantee order\n",
+			testRunId, result.Unordered)
+	}
+	fmt.Printf("testRunId %s, out of order deliveries = %d, mean reorder distance = %.3f, max reorder distance = %d\n",
+		testRunId, result.OutOfOrder, result.MeanReorderDistance, result.MaxReorderDistance)
+	for _, partition := range result.Partitions {
+		fmt.Printf("testRunId %s, partition key %q: out of order = %d of %d, max reorder distance = %d\n",
+			testRunId, partition.PartitionKey, partition.OutOfOrder, partition.Deliveries, partition.MaxReorderDistance)
+	}
+	fmt.Printf("testRunId %s, duplicated messages = %d, duplicate deliveries = %d\n",
+		testRunId, result.DuplicatedMessages, result.DuplicateDeliveries)
+}
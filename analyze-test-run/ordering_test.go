@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func orderingOutput(partitionKey string, messageNumber int, handlerStart time.Duration) Output {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Add(handlerStart)
+	return Output{PartitionKey: partitionKey, MessageNumber: messageNumber, HandlerStartTime: start.Format(time.RFC3339Nano)}
+}
+
+func TestOrderingCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs []Output
+		want    OrderingResult
+	}{
+		{
+			name: "in order, logged out of order",
+			outputs: []Output{
+				orderingOutput("a", 1, time.Second),
+				orderingOutput("a", 0, 0),
+				orderingOutput("a", 2, 2*time.Second),
+			},
+			want: OrderingResult{},
+		},
+		{
+			name: "out of order on one partition key",
+			outputs: []Output{
+				orderingOutput("a", 0, 0),
+				orderingOutput("a", 3, time.Second),
+				orderingOutput("a", 1, 2*time.Second),
+				orderingOutput("b", 2, 0),
+			},
+			want: OrderingResult{
+				Partitions:          []PartitionOrdering{{PartitionKey: "a", Deliveries: 3, OutOfOrder: 1, MaxReorderDistance: 2}},
+				OutOfOrder:          1,
+				MeanReorderDistance: 2,
+				MaxReorderDistance:  2,
+			},
+		},
+		{
+			name: "duplicates",
+			outputs: []Output{
+				orderingOutput("a", 0, 0),
+				orderingOutput("a", 0, time.Second),
+				orderingOutput("a", 0, 2*time.Second),
+				orderingOutput("a", 1, 3*time.Second),
+			},
+			want: OrderingResult{DuplicatedMessages: 1, DuplicateDeliveries: 2},
+		},
+		{
+			name: "standard queue",
+			outputs: []Output{
+				orderingOutput("", 1, 0),
+				orderingOutput("", 0, time.Second),
+			},
+			want: OrderingResult{Unordered: 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := newOrderingCheck()
+
+			for _, output := range test.outputs {
+				check.add(output)
+			}
+
+			if got := check.result(); !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestOrderingCheckIsBounded(t *testing.T) {
+	// A run of 100 s of in-order deliveries, on 26 partition keys that change every 10 s.
+	partitionKey := func(i int) string { return string(rune('a'+i%26)) + string(rune('a'+i/1000)) }
+
+	// The check is checkpointed halfway.
+	check := newOrderingCheck()
+	for i := 0; i < 10000; i++ {
+		check.add(orderingOutput(partitionKey(i), i, time.Duration(i)*10*time.Millisecond))
+		if i == 5000 {
+			serialized, err := json.Marshal(check.state())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state orderingState
+			if err := json.Unmarshal(serialized, &state); err != nil {
+				t.Fatal(err)
+			}
+			check = newOrderingCheck()
+			check.restore(state)
+		}
+	}
+
+	// Only the deliveries and partition keys of about the last window are held.
+	if len(check.pending) > int(orderingWindow/(10*time.Millisecond))+1 {
+		t.Errorf("expected at most a window of pending deliveries, got %d", len(check.pending))
+	}
+	if len(check.partitions) > 130 {
+		t.Errorf("expected idle partition keys to be forgotten, got %d of 260", len(check.partitions))
+	}
+	if got := check.result(); got.OutOfOrder != 0 || got.DuplicateDeliveries != 0 {
+		t.Errorf("expected no violations, got %+v", *got)
+	}
+}
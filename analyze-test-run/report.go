@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	statusComplete   = "complete"
+	statusInProgress = "in_progress"
+)
+
+// AnalyzeResult is returned by the handler, with one TransportResult per analyzed log group. An
+// analysis that is still in progress has handed off to another invocation, which stores the
+// complete result in the results bucket.
+type AnalyzeResult struct {
+	AnalysisId    string            `json:"analysis_id"`
+	Status        string            `json:"status"`
+	CheckpointKey string            `json:"checkpoint_key,omitempty"`
+	StartTime     time.Time         `json:"start_time"`
+	EndTime       time.Time         `json:"end_time"`
+	Transports    []TransportResult `json:"transports"`
+	Comparison    *CompareResult    `json:"comparison,omitempty"`
+	// Promoted lists the transports on which a run was promoted to baseline.
+	Promoted []string `json:"promoted,omitempty"`
+	// Report is where the HTML report was written, if the request asked for one.
+	Report string `json:"report,omitempty"`
+	// MetricsErrors lists the failed pushes to the metrics endpoints, with the status and body of
+	// their responses.
+	MetricsErrors []string `json:"metrics_errors,omitempty"`
+}
+
+type TransportResult struct {
+	Transport    string      `json:"transport"`
+	LogGroupName string      `json:"log_group_name"`
+	Backend      string      `json:"backend"`
+	Runs         []RunResult `json:"runs"`
+	Error        string      `json:"error,omitempty"`
+}
+
+type RunResult struct {
+	TestRunId string `json:"test_run_id"`
+	// ColdStarts counts the cold invocations of the run. Their init duration is only known to the
+	// platform, see Invocations.
+	ColdStarts int            `json:"cold_starts"`
+	All        LatencySummary `json:"all"`
+	Cold       LatencySummary `json:"cold"`
+	Warm       LatencySummary `json:"warm"`
+	Groups     []GroupResult  `json:"groups,omitempty"`
+	// Ordering is only checked by FilterLogEvents, it is nil from Logs Insights.
+	Ordering *OrderingResult `json:"ordering,omitempty"`
+	Slowest  []SlowDelivery  `json:"slowest,omitempty"`
+	// Invocations summarizes the REPORT lines of the invocations that handled the run.
+	Invocations *InvocationsResult `json:"invocations,omitempty"`
+	// Usage is what the run is billed by, and Cost its estimated cost in the region of the analyzer.
+	Usage *UsageResult `json:"usage,omitempty"`
+	Cost  *CostResult  `json:"cost,omitempty"`
+	// Aggregator is the aggregator that computed the percentiles, empty for Logs Insights.
+	Aggregator string            `json:"aggregator,omitempty"`
+	CrossCheck *CrossCheckResult `json:"cross_check,omitempty"`
+	// FunctionMemorySize is the memory size of the consumer function, MaxBatchSize the largest batch
+	// it was invoked with.
+	FunctionMemorySize int `json:"function_memory_size"`
+	MaxBatchSize       int `json:"max_batch_size"`
+	// RunStart is the start of the run stamped by the producer, nil from Logs Insights or when the
+	// producer stamps none.
+	RunStart *time.Time `json:"run_start,omitempty"`
+	// FirstReceived and LastReceived are the first and last receive times of the run. Throughput is
+	// the number of messages received per second between them.
+	FirstReceived   time.Time          `json:"first_received,omitempty"`
+	LastReceived    time.Time          `json:"last_received,omitempty"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	Throughput      float64            `json:"throughput"`
+	TimeSeries      *TimeSeriesResult  `json:"time_series,omitempty"`
+	SteadyState     *SteadyStateResult `json:"steady_state,omitempty"`
+	Shape           *ShapeResult       `json:"shape,omitempty"`
+	Heatmap         *HeatmapResult     `json:"heatmap,omitempty"`
+	// ServiceMetrics holds the CloudWatch metrics of the queue or stream and of the consumer function
+	// over the time the run was received.
+	ServiceMetrics *ServiceMetricsResult `json:"service_metrics,omitempty"`
+	// Distribution holds the distributionQuantiles of the run, for the charts of the HTML report.
+	Distribution []Percentile `json:"distribution,omitempty"`
+	// Baseline compares the run against the baseline of its scenario, if there is one.
+	Baseline *BaselineComparison `json:"baseline,omitempty"`
+}
+
+type GroupResult struct {
+	Group   string         `json:"group"`
+	Latency LatencySummary `json:"latency"`
+}
+
+// LatencySummary holds the count, moments and percentiles of a distribution, in milliseconds.
+type LatencySummary struct {
+	Count       uint64       `json:"count"`
+	Mean        float64      `json:"mean"`
+	StdDev      float64      `json:"stddev"`
+	TrimmedMean float64      `json:"trimmed_mean,omitempty"`
+	Percentiles []Percentile `json:"percentiles,omitempty"`
+}
+
+type Percentile struct {
+	Quantile float64             `json:"quantile"`
+	Value    float64             `json:"value"`
+	Interval *ConfidenceInterval `json:"interval,omitempty"`
+	// Insufficient is set when too few observations lie beyond the percentile to trust it, see
+	// minTailSamples.
+	Insufficient bool `json:"insufficient,omitempty"`
+}
+
+// percentileName formats a quantile the way percentiles are usually written, e.g. 0.999 as "p99.9".
+func percentileName(quantile float64) string {
+	return "p" + formatPercent(quantile)
+}
+
+// formatPercent formats a quantile as a percentage, rounded to 6 significant digits so that the
+// floating point error of the multiplication does not show, e.g. 0.07 as "7" rather than
+// "7.000000000000001".
+func formatPercent(quantile float64) string {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(quantile*100, 'g', 6, 64), 64)
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
+
+// writeTable writes the latency summaries of a run as a table, one row per distribution.
+func writeTable(w io.Writer, run RunResult) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := []string{"", "count", "mean", "stddev", "trimmed"}
+	for _, percentile := range run.All.Percentiles {
+		header = append(header, percentileName(percentile.Quantile))
+	}
+	fmt.Fprintln(table, strings.Join(header, "\t")+"\t")
+	writeRow := func(label string, summary LatencySummary) {
+		row := []string{label, strconv.FormatUint(summary.Count, 10)}
+		if summary.Count == 0 {
+			fmt.Fprintln(table, strings.Join(row, "\t")+"\t")
+			return
+		}
+		row = append(row, fmt.Sprintf("%.3f", summary.Mean), fmt.Sprintf("%.3f", summary.StdDev))
+		if summary.TrimmedMean != 0 {
+			row = append(row, fmt.Sprintf("%.3f", summary.TrimmedMean))
+		} else {
+			row = append(row, "-")
+		}
+		for _, percentile := range summary.Percentiles {
+			row = append(row, formatPercentile(percentile))
+		}
+		fmt.Fprintln(table, strings.Join(row, "\t")+"\t")
+	}
+	writeRow("all", run.All)
+	if run.SteadyState != nil {
+		writeRow("steady state", run.SteadyState.Latency)
+	}
+	writeRow("cold", run.Cold)
+	writeRow("warm", run.Warm)
+	if run.Invocations != nil {
+		writeRow("handler duration", run.Invocations.Duration)
+		writeRow("billed duration", run.Invocations.BilledDuration)
+		writeRow("init duration", run.Invocations.InitDuration)
+		writeRow("max memory used (MB)", run.Invocations.MaxMemoryUsed)
+	}
+	for _, group := range run.Groups {
+		writeRow(group.Group, group.Latency)
+	}
+	return table.Flush()
+}
+
+func printRunResult(backend string, run RunResult) {
+	fmt.Printf("testRunId %s, backend = %s, aggregator = %s\n", run.TestRunId, backend, run.Aggregator)
+	fmt.Printf("testRunId %s, cold starts = %d\n", run.TestRunId, run.ColdStarts)
+	if !run.FirstReceived.IsZero() {
+		fmt.Printf("testRunId %s, first received = %s, last received = %s, duration = %.3fs, throughput = %.1f msg/s\n",
+			run.TestRunId, run.FirstReceived.Format(time.RFC3339Nano), run.LastReceived.Format(time.RFC3339Nano), run.DurationSeconds, run.Throughput)
+	}
+	if run.Invocations != nil {
+		printInvocations(run.TestRunId, run.Invocations)
+	}
+	if run.SteadyState != nil {
+		printSteadyState(run.TestRunId, run.SteadyState)
+	}
+	fmt.Printf("testRunId %s, latency in milliseconds:\n", run.TestRunId)
+	if err := writeTable(os.Stdout, run); err != nil {
+		fmt.Printf("testRunId %s, failed to write table: %+v\n", run.TestRunId, err)
+	}
+	fmt.Printf("testRunId %s, percentiles are followed by their confidence interval, * marks fewer than %d observations in the tail\n",
+		run.TestRunId, minTailSamples)
+	if run.Cost != nil {
+		printCost(run.TestRunId, run.Cost)
+	} else if run.Usage != nil {
+		fmt.Printf("testRunId %s, no prices for region %s, cost not estimated, see PRICE_TABLE\n", run.TestRunId, region)
+	}
+	if run.Shape != nil {
+		printShape(run.TestRunId, run.Shape)
+	}
+	if run.TimeSeries != nil {
+		printTimeSeries(run.TestRunId, run.TimeSeries)
+	}
+	if run.ServiceMetrics != nil {
+		printServiceMetrics(run.TestRunId, run.ServiceMetrics)
+	}
+	if len(run.Slowest) > 0 {
+		printSlowest(run.TestRunId, run.Slowest)
+	}
+	if run.Ordering != nil {
+		printOrdering(run.TestRunId, *run.Ordering)
+	} else {
+		fmt.Printf("testRunId %s, ordering, duplicates, invocations from REPORT lines, usage and cost not computed by %s\n", run.TestRunId, backend)
+	}
+	if run.CrossCheck != nil {
+		printCrossCheck(run.TestRunId, run.CrossCheck)
+	}
+	// The same result as a single line of JSON, for log queries and tools.
+	serialized, _ := json.Marshal(run)
+	fmt.Printf("testRunId %s, result = %s\n", run.TestRunId, serialized)
+}
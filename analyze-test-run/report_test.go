@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestPercentileName(t *testing.T) {
+	tests := []struct {
+		quantile float64
+		want     string
+	}{
+		{quantile: 0, want: "p0"},
+		{quantile: 0.07, want: "p7"},
+		{quantile: 0.29, want: "p29"},
+		{quantile: 0.5, want: "p50"},
+		{quantile: 0.999, want: "p99.9"},
+		{quantile: 0.9999, want: "p99.99"},
+		{quantile: 1, want: "p100"},
+	}
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			if got := percentileName(test.quantile); got != test.want {
+				t.Errorf("expected %s for %g, got %s", test.want, test.quantile, got)
+			}
+		})
+	}
+}
+
+func TestThresholdByPercentileName(t *testing.T) {
+	// The quantile 0.07 of p7 is 7.000000000000001 percent in floating point.
+	regressionThreshold := 0.1
+	request := AnalyzeRequest{RegressionThreshold: &regressionThreshold, Thresholds: map[string]float64{"p7": 0.5}}
+
+	p7, p50 := request.threshold(0.07), request.threshold(0.5)
+
+	if p7 != 0.5 || p50 != 0.1 {
+		t.Errorf("expected thresholds of 0.5 and 0.1, got %g and %g", p7, p50)
+	}
+}
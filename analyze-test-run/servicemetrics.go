@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// metricPeriodStep is the finest period of standard resolution service metrics.
+const metricPeriodStep = time.Minute
+
+// transportResources names the queue or stream a transport delivers through, for its service
+// metrics. The consumer function is taken from the log group of the transport.
+type transportResources struct {
+	QueueName    string
+	StreamName   string
+	ConsumerName string
+}
+
+// serviceMetricsResources holds the resources of each transport, keyed like logGroupNames. Discovered
+// transports have none, and only get the metrics of their consumer function.
+var serviceMetricsResources = make(map[string]transportResources)
+
+// ServiceMetricsResult holds the CloudWatch metrics of the services a run went through, over the
+// time the run was received, in periods of PeriodSeconds.
+type ServiceMetricsResult struct {
+	PeriodSeconds int             `json:"period_seconds"`
+	Metrics       []ServiceMetric `json:"metrics"`
+}
+
+// ServiceMetric is a statistic of a CloudWatch metric over time.
+type ServiceMetric struct {
+	Namespace string        `json:"namespace"`
+	Name      string        `json:"name"`
+	Stat      string        `json:"stat"`
+	Points    []MetricPoint `json:"points"`
+}
+
+type MetricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type metricQuery struct {
+	namespace  string
+	name       string
+	stat       string
+	dimensions map[string]string
+}
+
+// serviceMetricQueries lists the metrics that explain the latency of a transport: the backlog of its
+// queue or how far its stream consumer lags behind, and the concurrency and throttles of its consumer
+// function.
+func serviceMetricQueries(transport string) []metricQuery {
+	resources := serviceMetricsResources[transport]
+	var queries []metricQuery
+	if resources.QueueName != "" {
+		queue := map[string]string{"QueueName": resources.QueueName}
+		queries = append(queries,
+			metricQuery{"AWS/SQS", "ApproximateAgeOfOldestMessage", "Maximum", queue},
+			metricQuery{"AWS/SQS", "ApproximateNumberOfMessagesVisible", "Maximum", queue},
+		)
+	}
+	if resources.StreamName != "" {
+		stream := map[string]string{"StreamName": resources.StreamName}
+		queries = append(queries,
+			metricQuery{"AWS/Kinesis", "GetRecords.IteratorAgeMilliseconds", "Maximum", stream},
+			metricQuery{"AWS/Kinesis", "WriteProvisionedThroughputExceeded", "Sum", stream},
+		)
+		if resources.ConsumerName != "" {
+			queries = append(queries, metricQuery{"AWS/Kinesis", "SubscribeToShardEvent.MillisBehindLatest", "Maximum",
+				map[string]string{"StreamName": resources.StreamName, "ConsumerName": resources.ConsumerName}})
+		}
+	}
+	if functionName := strings.TrimPrefix(logGroupNames[transport], "/aws/lambda/"); functionName != "" {
+		function := map[string]string{"FunctionName": functionName}
+		queries = append(queries,
+			metricQuery{"AWS/Lambda", "ConcurrentExecutions", "Maximum", function},
+			metricQuery{"AWS/Lambda", "Throttles", "Sum", function},
+		)
+	}
+	return queries
+}
+
+// metricPeriod is the period the service metrics of a run are fetched in: the bucket width of its
+// time series rounded up to whole minutes, so that the metrics line up with its buckets.
+func (request AnalyzeRequest) metricPeriod() time.Duration {
+	period := request.bucketWidth()
+	if period%metricPeriodStep != 0 {
+		period = (period/metricPeriodStep + 1) * metricPeriodStep
+	}
+	return period
+}
+
+// metricDataInput builds the GetMetricData input of the queries of a run, and the result their data
+// is collected in, with a metric per query in the same order. The time range covers the time the run
+// was received, or the time range of the request if the receive times are unknown, widened by a
+// period on each side and aligned to periods.
+func metricDataInput(request AnalyzeRequest, queries []metricQuery, run RunResult) (*cloudwatch.GetMetricDataInput, *ServiceMetricsResult) {
+	period := request.metricPeriod()
+	startTime, endTime := *request.StartTime, *request.EndTime
+	if !run.FirstReceived.IsZero() {
+		startTime, endTime = run.FirstReceived.Add(-period), run.LastReceived.Add(period)
+	}
+
+	result := &ServiceMetricsResult{PeriodSeconds: int(period.Seconds())}
+	var dataQueries []cloudwatchtypes.MetricDataQuery
+	for i, query := range queries {
+		names := make([]string, 0, len(query.dimensions))
+		for name := range query.dimensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var dimensions []cloudwatchtypes.Dimension
+		for _, name := range names {
+			dimensions = append(dimensions, cloudwatchtypes.Dimension{Name: aws.String(name), Value: aws.String(query.dimensions[name])})
+		}
+		dataQueries = append(dataQueries, cloudwatchtypes.MetricDataQuery{
+			Id: aws.String(fmt.Sprintf("m%d", i)),
+			MetricStat: &cloudwatchtypes.MetricStat{
+				Metric: &cloudwatchtypes.Metric{
+					Namespace:  aws.String(query.namespace),
+					MetricName: aws.String(query.name),
+					Dimensions: dimensions,
+				},
+				Period: aws.Int32(int32(period.Seconds())),
+				Stat:   aws.String(query.stat),
+			},
+		})
+		result.Metrics = append(result.Metrics, ServiceMetric{Namespace: query.namespace, Name: query.name, Stat: query.stat})
+	}
+	input := &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(startTime.Truncate(period)),
+		EndTime:           aws.Time(endTime.Truncate(period).Add(period)),
+		MetricDataQueries: dataQueries,
+		ScanBy:            cloudwatchtypes.ScanByTimestampAscending,
+	}
+	return input, result
+}
+
+// fetchServiceMetrics gets the service metrics of a transport with GetMetricData, see metricDataInput.
+func fetchServiceMetrics(ctx context.Context, request AnalyzeRequest, transport string, run RunResult) (*ServiceMetricsResult, error) {
+	queries := serviceMetricQueries(transport)
+	if len(queries) == 0 {
+		return nil, nil
+	}
+	input, result := metricDataInput(request, queries, run)
+	paginator := cloudwatch.NewGetMetricDataPaginator(cloudwatchClient, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get metric data, %w", err)
+		}
+		for _, data := range page.MetricDataResults {
+			var i int
+			if _, err := fmt.Sscanf(aws.ToString(data.Id), "m%d", &i); err != nil || i >= len(result.Metrics) {
+				continue
+			}
+			for k, timestamp := range data.Timestamps {
+				result.Metrics[i].Points = append(result.Metrics[i].Points, MetricPoint{Time: timestamp.UTC(), Value: data.Values[k]})
+			}
+		}
+	}
+	return result, nil
+}
+
+func printServiceMetrics(testRunId string, metrics *ServiceMetricsResult) {
+	for _, metric := range metrics.Metrics {
+		if len(metric.Points) == 0 {
+			fmt.Printf("testRunId %s, %s %s: no data\n", testRunId, metric.Namespace, metric.Name)
+			continue
+		}
+		peak := metric.Points[0]
+		for _, point := range metric.Points {
+			if point.Value > peak.Value {
+				peak = point
+			}
+		}
+		fmt.Printf("testRunId %s, %s %s: %s peaks at %g at %s\n",
+			testRunId, metric.Namespace, metric.Name, strings.ToLower(metric.Stat), peak.Value, peak.Time.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestMetricPeriod(t *testing.T) {
+	tests := []struct {
+		bucketWidth string
+		want        time.Duration
+	}{
+		{bucketWidth: "", want: time.Minute},
+		{bucketWidth: "10s", want: time.Minute},
+		{bucketWidth: "1m", want: time.Minute},
+		{bucketWidth: "90s", want: 2 * time.Minute},
+		{bucketWidth: "5m", want: 5 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.bucketWidth, func(t *testing.T) {
+			if got := (AnalyzeRequest{BucketWidth: test.bucketWidth}).metricPeriod(); got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMetricDataInput(t *testing.T) {
+	requestStart := time.Date(2024, 5, 1, 12, 0, 30, 0, time.UTC)
+	requestEnd := time.Date(2024, 5, 1, 12, 10, 30, 0, time.UTC)
+	request := AnalyzeRequest{StartTime: &requestStart, EndTime: &requestEnd, BucketWidth: "90s"}
+	queries := []metricQuery{
+		{"AWS/SQS", "ApproximateAgeOfOldestMessage", "Maximum", map[string]string{"QueueName": "queue"}},
+		{"AWS/Kinesis", "SubscribeToShardEvent.MillisBehindLatest", "Maximum", map[string]string{"StreamName": "stream", "ConsumerName": "consumer"}},
+	}
+	tests := []struct {
+		name      string
+		run       RunResult
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "time range of the request",
+			wantStart: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 1, 12, 12, 0, 0, time.UTC),
+		},
+		{
+			// Widened by the 2 minute period on each side, then aligned to periods.
+			name: "time the run was received",
+			run: RunResult{
+				FirstReceived: time.Date(2024, 5, 1, 12, 5, 10, 0, time.UTC),
+				LastReceived:  time.Date(2024, 5, 1, 12, 6, 50, 0, time.UTC),
+			},
+			wantStart: time.Date(2024, 5, 1, 12, 2, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 5, 1, 12, 10, 0, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input, result := metricDataInput(request, queries, test.run)
+			if !aws.ToTime(input.StartTime).Equal(test.wantStart) || !aws.ToTime(input.EndTime).Equal(test.wantEnd) {
+				t.Errorf("expected %s to %s, got %s to %s", test.wantStart, test.wantEnd, aws.ToTime(input.StartTime), aws.ToTime(input.EndTime))
+			}
+			if result.PeriodSeconds != 120 || len(result.Metrics) != len(queries) {
+				t.Fatalf("expected a metric per query in periods of 120s, got %+v", result)
+			}
+			if len(input.MetricDataQueries) != len(queries) {
+				t.Fatalf("expected a data query per query, got %d", len(input.MetricDataQueries))
+			}
+			for i, query := range queries {
+				dataQuery := input.MetricDataQueries[i]
+				stat := dataQuery.MetricStat
+				if aws.ToString(dataQuery.Id) != fmt.Sprintf("m%d", i) || aws.ToInt32(stat.Period) != 120 || aws.ToString(stat.Stat) != query.stat ||
+					aws.ToString(stat.Metric.Namespace) != query.namespace || aws.ToString(stat.Metric.MetricName) != query.name {
+					t.Errorf("expected data query %d to be for %+v, got %+v", i, query, dataQuery)
+				}
+				if result.Metrics[i].Name != query.name {
+					t.Errorf("expected metric %d to be %s, got %s", i, query.name, result.Metrics[i].Name)
+				}
+			}
+			dimensions := input.MetricDataQueries[1].MetricStat.Metric.Dimensions
+			if len(dimensions) != 2 || aws.ToString(dimensions[0].Name) != "ConsumerName" || aws.ToString(dimensions[0].Value) != "consumer" ||
+				aws.ToString(dimensions[1].Name) != "StreamName" || aws.ToString(dimensions[1].Value) != "stream" {
+				t.Errorf("expected the dimensions of the consumer sorted by name, got %+v", dimensions)
+			}
+		})
+	}
+}
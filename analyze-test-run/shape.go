@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// shapeSampleSize is the number of evenly spaced quantiles a distribution is represented by when
+	// fitting its shape, so that the fit does not depend on the aggregator or on the number of
+	// deliveries.
+	shapeSampleSize = 1000
+	// shapeMinLatency is the lowest latency in milliseconds the shape is fitted on. Latencies are
+	// fitted on a log scale, so lower ones, e.g. from clock skew, are raised to it.
+	shapeMinLatency = 0.001
+	// shapeMinVariance is the lowest variance of a mixture component on the log scale, so that a
+	// component cannot collapse onto a run of identical latencies.
+	shapeMinVariance = 1e-4
+	// bimodalMinFraction is the smallest fraction of the deliveries a mode must hold to be reported.
+	bimodalMinFraction = 0.05
+	// bimodalMinSeparation is the lowest Ashman's D of two modes for them to be told apart, below
+	// it the mixture only describes the skew of a single mode.
+	bimodalMinSeparation = 2
+	// heatmapBins is the number of logarithmic latency bins of a heatmap.
+	heatmapBins = 30
+)
+
+const (
+	modeSingle = "single"
+	modeFast   = "fast"
+	modeSlow   = "slow"
+)
+
+// ShapeResult describes the shape of the latency distribution of a run, from a mixture of two
+// log-normal distributions fitted against a single one. The distribution is bimodal when the
+// mixture has the lower BIC, its modes are apart, its density has two peaks and each mode holds a
+// fair share of the deliveries.
+type ShapeResult struct {
+	Bimodal bool `json:"bimodal"`
+	// BICDelta is the BIC of a single log-normal distribution less that of the mixture, positive when
+	// the mixture fits better.
+	BICDelta float64 `json:"bic_delta"`
+	// Separation is Ashman's D of the two components of the mixture.
+	Separation float64 `json:"separation"`
+	Modes      []Mode  `json:"modes"`
+}
+
+// Mode is a mode of a latency distribution, in milliseconds. Lower and Upper bound 95% of its
+// deliveries; ColdFraction is the fraction of them handled by a cold consumer.
+type Mode struct {
+	Name         string  `json:"name"`
+	Center       float64 `json:"center"`
+	Lower        float64 `json:"lower"`
+	Upper        float64 `json:"upper"`
+	Fraction     float64 `json:"fraction"`
+	Count        uint64  `json:"count"`
+	ColdFraction float64 `json:"cold_fraction"`
+}
+
+// HeatmapResult counts the deliveries of a run by receive time and latency. Latencies holds the
+// edges of the latency bins in milliseconds; the first bin also holds lower latencies. Counts holds
+// a row of counts per latency bin for each bucket of Starts, estimated from the bucket's t-digest.
+type HeatmapResult struct {
+	BucketWidth string      `json:"bucket_width"`
+	Starts      []time.Time `json:"starts"`
+	Latencies   []float64   `json:"latencies"`
+	Counts      [][]uint64  `json:"counts"`
+}
+
+// component is a normal distribution of log latencies, weighted by its share of a mixture.
+type component struct {
+	weight   float64
+	mean     float64
+	variance float64
+}
+
+func (c component) density(x float64) float64 {
+	return c.weight * math.Exp(-(x-c.mean)*(x-c.mean)/(2*c.variance)) / math.Sqrt(2*math.Pi*c.variance)
+}
+
+// logSample returns the logs of evenly spaced quantiles of a distribution, see shapeSampleSize.
+func logSample(a aggregator) []float64 {
+	sample := make([]float64, shapeSampleSize)
+	for i := range sample {
+		sample[i] = math.Log(math.Max(a.Quantile((float64(i)+0.5)/shapeSampleSize), shapeMinLatency))
+	}
+	return sample
+}
+
+func fitNormal(sample []float64) component {
+	var sum, sumOfSquares float64
+	for _, x := range sample {
+		sum += x
+	}
+	mean := sum / float64(len(sample))
+	for _, x := range sample {
+		sumOfSquares += (x - mean) * (x - mean)
+	}
+	return component{weight: 1, mean: mean, variance: math.Max(sumOfSquares/float64(len(sample)), shapeMinVariance)}
+}
+
+func logLikelihood(sample []float64, components []component) float64 {
+	var l float64
+	for _, x := range sample {
+		var density float64
+		for _, c := range components {
+			density += c.density(x)
+		}
+		l += math.Log(math.Max(density, math.SmallestNonzeroFloat64))
+	}
+	return l
+}
+
+// fitMixture fits a mixture of two normal distributions to a sorted sample with expectation
+// maximization, starting from its lower and upper halves. The components are returned in order of
+// their means.
+func fitMixture(sample []float64) []component {
+	half := len(sample) / 2
+	components := []component{fitNormal(sample[:half]), fitNormal(sample[half:])}
+	components[0].weight, components[1].weight = 0.5, 0.5
+	responsibilities := make([]float64, len(sample))
+	previous := math.Inf(-1)
+iterations:
+	for iteration := 0; iteration < 500; iteration++ {
+		// Expectation: the probability that each value comes from the first component.
+		for i, x := range sample {
+			first, second := components[0].density(x), components[1].density(x)
+			responsibilities[i] = 0.5
+			if first+second > 0 {
+				responsibilities[i] = first / (first + second)
+			}
+		}
+		// Maximization: the weighted moments of each component.
+		for k := range components {
+			var weight, sum float64
+			for i, x := range sample {
+				r := responsibilities[i]
+				if k == 1 {
+					r = 1 - r
+				}
+				weight += r
+				sum += r * x
+			}
+			if weight == 0 {
+				break iterations
+			}
+			mean := sum / weight
+			var sumOfSquares float64
+			for i, x := range sample {
+				r := responsibilities[i]
+				if k == 1 {
+					r = 1 - r
+				}
+				sumOfSquares += r * (x - mean) * (x - mean)
+			}
+			components[k] = component{
+				weight:   weight / float64(len(sample)),
+				mean:     mean,
+				variance: math.Max(sumOfSquares/weight, shapeMinVariance),
+			}
+		}
+		l := logLikelihood(sample, components)
+		if l-previous < 1e-9*math.Abs(l) {
+			break
+		}
+		previous = l
+	}
+	if components[0].mean > components[1].mean {
+		components[0], components[1] = components[1], components[0]
+	}
+	return components
+}
+
+// shape fits the shape of the latency distribution of the run. The BIC is computed for the number
+// of deliveries rather than the size of the sample, which stands for them.
+func (r *runAggregate) shape() *ShapeResult {
+	if r.all.Count() < 2 {
+		return nil
+	}
+	sample := logSample(r.all)
+	n := float64(r.all.Count())
+	scale := n / float64(len(sample))
+	single := fitNormal(sample)
+	mixture := fitMixture(sample)
+	bicSingle := 2*math.Log(n) - 2*scale*logLikelihood(sample, []component{single})
+	bicMixture := 5*math.Log(n) - 2*scale*logLikelihood(sample, mixture)
+	result := &ShapeResult{
+		BICDelta:   bicSingle - bicMixture,
+		Separation: math.Sqrt2 * math.Abs(mixture[1].mean-mixture[0].mean) / math.Sqrt(mixture[0].variance+mixture[1].variance),
+	}
+	result.Bimodal = result.BICDelta > 0 && result.Separation > bimodalMinSeparation &&
+		math.Min(mixture[0].weight, mixture[1].weight) >= bimodalMinFraction && peaks(mixture) == 2
+	if !result.Bimodal {
+		mode := newMode(modeSingle, single, r.all.Count())
+		mode.ColdFraction = float64(r.cold.Count()) / n
+		result.Modes = []Mode{mode}
+		return result
+	}
+
+	// Cold deliveries are attributed to the modes by the probability that they come from each.
+	coldCounts := make([]float64, len(mixture))
+	if r.cold.Count() > 0 {
+		coldSample := logSample(r.cold)
+		coldScale := float64(r.cold.Count()) / float64(len(coldSample))
+		for _, x := range coldSample {
+			fast, slow := mixture[0].density(x), mixture[1].density(x)
+			if fast+slow == 0 {
+				continue
+			}
+			coldCounts[0] += coldScale * fast / (fast + slow)
+			coldCounts[1] += coldScale * slow / (fast + slow)
+		}
+	}
+	for k, name := range []string{modeFast, modeSlow} {
+		mode := newMode(name, mixture[k], r.all.Count())
+		if mode.Count > 0 {
+			mode.ColdFraction = math.Min(coldCounts[k]/float64(mode.Count), 1)
+		}
+		result.Modes = append(result.Modes, mode)
+	}
+	return result
+}
+
+// peaks counts the local maxima of the density of a mixture between three standard deviations
+// below its lowest component and above its highest. Two well separated components can still have a
+// single peak when one is much wider than the other.
+func peaks(mixture []component) int {
+	low := mixture[0].mean - 3*math.Sqrt(mixture[0].variance)
+	high := mixture[len(mixture)-1].mean + 3*math.Sqrt(mixture[len(mixture)-1].variance)
+	const steps = 500
+	density := func(step int) float64 {
+		x := low + (high-low)*float64(step)/steps
+		var d float64
+		for _, c := range mixture {
+			d += c.density(x)
+		}
+		return d
+	}
+	count := 0
+	previous, current := density(0), density(1)
+	for step := 1; step < steps; step++ {
+		next := density(step + 1)
+		if current > previous && current >= next {
+			count++
+		}
+		previous, current = current, next
+	}
+	return count
+}
+
+func newMode(name string, c component, count uint64) Mode {
+	deviation := math.Sqrt(c.variance)
+	return Mode{
+		Name:     name,
+		Center:   math.Exp(c.mean),
+		Lower:    math.Exp(c.mean - 1.96*deviation),
+		Upper:    math.Exp(c.mean + 1.96*deviation),
+		Fraction: c.weight,
+		Count:    uint64(math.Round(c.weight * float64(count))),
+	}
+}
+
+// heatmap bins the time series by receive time of the run by latency, on a log scale between the
+// lowest positive and the highest latency of the run.
+func (r *runAggregate) heatmap() *HeatmapResult {
+	if r.byReceived == nil || len(r.byReceived.buckets) == 0 {
+		return nil
+	}
+	low := math.Max(r.all.Quantile(0), shapeMinLatency)
+	high := math.Max(r.all.Quantile(1), low*10)
+	step := (math.Log10(high) - math.Log10(low)) / heatmapBins
+	result := &HeatmapResult{BucketWidth: r.request.BucketWidth}
+	for i := 0; i <= heatmapBins; i++ {
+		result.Latencies = append(result.Latencies, math.Pow(10, math.Log10(low)+float64(i)*step))
+	}
+	for _, start := range r.byReceived.starts() {
+		bucket := r.byReceived.buckets[start]
+		bucketDistribution := distribution(bucket)
+		counts := make([]uint64, heatmapBins)
+		lower := 0.0
+		for k := range counts {
+			upper := cdf(bucketDistribution, result.Latencies[k+1])
+			if k == heatmapBins-1 {
+				upper = 1
+			}
+			counts[k] = uint64(math.Round((upper - lower) * float64(bucket.Count())))
+			lower = upper
+		}
+		result.Starts = append(result.Starts, time.Unix(0, start).UTC())
+		result.Counts = append(result.Counts, counts)
+	}
+	return result
+}
+
+// describe names the modes of a shape and the share of the deliveries in each, in a sentence.
+func (s *ShapeResult) describe() string {
+	var modes []string
+	for _, mode := range s.Modes {
+		modes = append(modes, fmt.Sprintf("%s mode around %.3f ms (95%% within %.3f to %.3f ms) with %.1f%% of deliveries, %.1f%% of them cold",
+			mode.Name, mode.Center, mode.Lower, mode.Upper, mode.Fraction*100, mode.ColdFraction*100))
+	}
+	shape := "unimodal"
+	if s.Bimodal {
+		shape = "bimodal"
+	}
+	return fmt.Sprintf("%s (BIC delta %.1f, separation %.2f): %s", shape, s.BICDelta, s.Separation, strings.Join(modes, "; "))
+}
+
+func printShape(testRunId string, shape *ShapeResult) {
+	fmt.Printf("testRunId %s, latency distribution is %s\n", testRunId, shape.describe())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestShape(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency func(random *rand.Rand, i int) float64
+		bimodal bool
+	}{
+		{
+			name: "unimodal",
+			latency: func(random *rand.Rand, i int) float64 {
+				return 20 * math.Exp(0.3*random.NormFloat64())
+			},
+			bimodal: false,
+		},
+		{
+			name: "bimodal",
+			latency: func(random *rand.Rand, i int) float64 {
+				if i%10 < 3 {
+					return 200 * math.Exp(0.2*random.NormFloat64())
+				}
+				return 10 * math.Exp(0.2*random.NormFloat64())
+			},
+			bimodal: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := resolveRequest(AnalyzeRequest{Backend: backendFilter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			run := newRunAggregate(request)
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 5000; i++ {
+				run.all.Add(test.latency(random, i))
+			}
+
+			shape := run.shape()
+
+			// The modes are the ones the latencies were drawn from.
+			if shape.Bimodal != test.bimodal {
+				t.Fatalf("expected bimodal = %v, got %+v", test.bimodal, *shape)
+			}
+			if !test.bimodal {
+				if len(shape.Modes) != 1 || math.Abs(shape.Modes[0].Center-20) > 1 {
+					t.Errorf("expected a single mode around 20 ms, got %+v", shape.Modes)
+				}
+				return
+			}
+			fast, slow := shape.Modes[0], shape.Modes[1]
+			if math.Abs(fast.Center-10) > 1 || math.Abs(fast.Fraction-0.7) > 0.02 {
+				t.Errorf("expected a fast mode of 70%% around 10 ms, got %+v", fast)
+			}
+			if math.Abs(slow.Center-200) > 20 || math.Abs(slow.Fraction-0.3) > 0.02 {
+				t.Errorf("expected a slow mode of 30%% around 200 ms, got %+v", slow)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// SlowDelivery is one of the slowest deliveries of a run, with what it takes to find its log event.
+// ShardId is only set on streams; on queues, the transport names the queue. URL deep-links to the
+// log event in the CloudWatch console.
+type SlowDelivery struct {
+	LatencyMs        float64   `json:"latency_ms"`
+	EventId          string    `json:"event_id"`
+	MessageNumber    int       `json:"message_number"`
+	ShardId          string    `json:"shard_id,omitempty"`
+	PartitionKey     string    `json:"partition_key,omitempty"`
+	RequestId        string    `json:"request_id"`
+	ColdStart        bool      `json:"cold_start"`
+	TimeSent         time.Time `json:"time_sent"`
+	HandlerStartTime time.Time `json:"handler_start_time"`
+	LogStreamName    string    `json:"log_stream_name,omitempty"`
+	LogTimestamp     time.Time `json:"log_timestamp"`
+	URL              string    `json:"url,omitempty"`
+}
+
+// slowDeliveries is a min-heap of deliveries by latency, so that the fastest of the slowest is the
+// one replaced by a slower delivery.
+type slowDeliveries []SlowDelivery
+
+func (h slowDeliveries) Len() int            { return len(h) }
+func (h slowDeliveries) Less(i, j int) bool  { return h[i].LatencyMs < h[j].LatencyMs }
+func (h slowDeliveries) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowDeliveries) Push(x interface{}) { *h = append(*h, x.(SlowDelivery)) }
+func (h *slowDeliveries) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// slowest keeps the slowest deliveries of a run, at most limit of them.
+type slowest struct {
+	limit      int
+	deliveries slowDeliveries
+}
+
+func newSlowest(limit int) *slowest {
+	return &slowest{limit: limit}
+}
+
+// add offers the delivery logged in a log event. The log event is only looked at for deliveries
+// slow enough to be kept.
+func (s *slowest) add(output Output, logGroupName string, event types.FilteredLogEvent) {
+	latency := milliseconds(time.Duration(output.TimeDiffNs))
+	if s.limit == 0 || len(s.deliveries) == s.limit && latency <= s.deliveries[0].LatencyMs {
+		return
+	}
+	var logTimestamp time.Time
+	if event.Timestamp != nil {
+		logTimestamp = time.UnixMilli(*event.Timestamp).UTC()
+	}
+	s.push(newSlowDelivery(output, logGroupName, aws.ToString(event.LogStreamName), logTimestamp))
+}
+
+func (s *slowest) push(delivery SlowDelivery) {
+	heap.Push(&s.deliveries, delivery)
+	if len(s.deliveries) > s.limit {
+		heap.Pop(&s.deliveries)
+	}
+}
+
+// result returns the slowest deliveries, slowest first.
+func (s *slowest) result() []SlowDelivery {
+	deliveries := append([]SlowDelivery(nil), s.deliveries...)
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].LatencyMs > deliveries[j].LatencyMs
+	})
+	return deliveries
+}
+
+// restore adds the deliveries of a checkpoint back to the heap.
+func (s *slowest) restore(deliveries []SlowDelivery) {
+	for _, delivery := range deliveries {
+		s.push(delivery)
+	}
+}
+
+func newSlowDelivery(output Output, logGroupName string, logStreamName string, logTimestamp time.Time) SlowDelivery {
+	delivery := SlowDelivery{
+		LatencyMs:     milliseconds(time.Duration(output.TimeDiffNs)),
+		EventId:       output.EventId,
+		MessageNumber: output.MessageNumber,
+		ShardId:       output.ShardId,
+		PartitionKey:  output.PartitionKey,
+		RequestId:     output.RequestId,
+		ColdStart:     output.ColdStart,
+		LogStreamName: logStreamName,
+		LogTimestamp:  logTimestamp,
+		URL:           logEventURL(logGroupName, logStreamName, logTimestamp, output.EventId),
+	}
+	if datum, ok := output.datum(); ok {
+		delivery.TimeSent, _ = datum.sentAt()
+	}
+	delivery.HandlerStartTime, _ = time.Parse(time.RFC3339Nano, output.HandlerStartTime)
+	return delivery
+}
+
+// consoleEscape escapes a value for the fragment of a CloudWatch console URL, which escapes values
+// twice, the second time with '$' in place of '%'.
+func consoleEscape(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(value), "+", "%20"), "%", "$25")
+}
+
+// logEventURL links to a log event in the CloudWatch console, by showing the millisecond of its log
+// stream it was logged in, filtered down to its event ID.
+func logEventURL(logGroupName string, logStreamName string, timestamp time.Time, eventId string) string {
+	if region == "" || logGroupName == "" || logStreamName == "" {
+		return ""
+	}
+	start := timestamp.UnixMilli()
+	query := fmt.Sprintf("$3Fstart$3D%d$26end$3D%d", start, start+1)
+	if eventId != "" {
+		query += "$26filterPattern$3D" + consoleEscape(strconv.Quote(eventId))
+	}
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logsV2:log-groups/log-group/%s/log-events/%s%s",
+		region, region, consoleEscape(logGroupName), consoleEscape(logStreamName), query)
+}
+
+// slowestQuery builds a Logs Insights query for the slowest deliveries of a test run, returning
+// their log events whole.
+func slowestQuery(testRunId string, limit int) string {
+	return strings.Join([]string{
+		`parse @message /"test_run_id":"(?<run_id>[^"]*)"/`,
+		`parse @message /"time_diff_ns":(?<latency_ns>\d+)/`,
+		fmt.Sprintf("filter ispresent(latency_ns) and run_id = %s", strconv.Quote(testRunId)),
+		"fields @timestamp, @logStream, @message, latency_ns / 1000000 as latency_ms",
+		"sort latency_ms desc",
+		fmt.Sprintf("limit %d", limit),
+	}, " | ")
+}
+
+// insightsSlowest queries the slowest deliveries of a test run with Logs Insights.
+func insightsSlowest(ctx context.Context, logGroupName string, request AnalyzeRequest, testRunId string, startTime time.Time, endTime time.Time) ([]SlowDelivery, error) {
+	rows, err := runInsightsQuery(ctx, logGroupName, slowestQuery(testRunId, *request.Slowest), startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []SlowDelivery
+	for _, row := range rows {
+		var output Output
+		if err := json.Unmarshal([]byte(row["@message"]), &output); err != nil {
+			continue
+		}
+		logTimestamp, _ := time.Parse(insightsTimestampLayout, row["@timestamp"])
+		deliveries = append(deliveries, newSlowDelivery(output, logGroupName, row["@logStream"], logTimestamp))
+	}
+	return deliveries, nil
+}
+
+func printSlowest(testRunId string, deliveries []SlowDelivery) {
+	fmt.Printf("testRunId %s, %d slowest deliveries:\n", testRunId, len(deliveries))
+	for _, delivery := range deliveries {
+		source := delivery.ShardId
+		if source == "" {
+			source = "-"
+		}
+		fmt.Printf("testRunId %s, slow delivery %.3f ms: event %s, message %d, shard %s, request %s, cold %t, sent %s, handled %s, logged %s in %s %s\n",
+			testRunId, delivery.LatencyMs, delivery.EventId, delivery.MessageNumber, source, delivery.RequestId, delivery.ColdStart,
+			delivery.TimeSent.Format(time.RFC3339Nano), delivery.HandlerStartTime.Format(time.RFC3339Nano),
+			delivery.LogTimestamp.Format(time.RFC3339Nano), delivery.LogStreamName, delivery.URL)
+	}
+}
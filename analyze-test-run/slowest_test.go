@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+func TestSlowest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    int
+	}{
+		{name: "default", request: `{"backend":"filter"}`, want: 10},
+		{name: "disabled", request: `{"backend":"filter","slowest":0}`, want: 0},
+		{name: "three", request: `{"backend":"filter","slowest":3}`, want: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var request AnalyzeRequest
+			if err := json.Unmarshal([]byte(test.request), &request); err != nil {
+				t.Fatal(err)
+			}
+			request, err := resolveRequest(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			run := newRunAggregate(request)
+
+			for i := 0; i < 20; i++ {
+				output := Output{MessageNumber: i, TimeDiffNs: i * int(time.Millisecond)}
+				run.slowest.add(output, "log-group", types.FilteredLogEvent{})
+			}
+
+			slowest := run.result("run").Slowest
+			if len(slowest) != test.want {
+				t.Fatalf("expected %d slowest deliveries, got %d", test.want, len(slowest))
+			}
+			if test.want > 0 && slowest[0].LatencyMs != 19 {
+				t.Errorf("expected the slowest delivery first, got %+v", slowest[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caio/go-tdigest/v4"
+)
+
+const (
+	// steadyStateProducer leaves out the messages the producer stamped as warm-up.
+	steadyStateProducer = "producer"
+	// steadyStateMser leaves out the buckets before the truncation point found by MSER.
+	steadyStateMser = "mser"
+)
+
+// mserMinBuckets is the fewest buckets MSER is run on, below it the run is too short to tell
+// warm-up from noise.
+const mserMinBuckets = 5
+
+// SteadyStateResult holds the latency of a run once it reached its steady state, and how the
+// warm-up before it was found. WarmUpEnd is the send time at which the steady state starts, when it
+// was detected by MSER.
+type SteadyStateResult struct {
+	Method         string         `json:"method"`
+	WarmUpEnd      *time.Time     `json:"warm_up_end,omitempty"`
+	WarmUpMessages uint64         `json:"warm_up_messages"`
+	Latency        LatencySummary `json:"latency"`
+}
+
+// steadyState returns the steady state latency of the run, from the warm-up stamped by the producer
+// if there is any, otherwise detected by MSER when the request asks for it.
+func (r *runAggregate) steadyState() *SteadyStateResult {
+	if r.warmUpMessages > 0 {
+		return &SteadyStateResult{
+			Method:         steadyStateProducer,
+			WarmUpMessages: r.warmUpMessages,
+			Latency:        r.request.summarize(r.steady, nil),
+		}
+	}
+	if !r.request.SteadyState || len(r.bySent.buckets) < mserMinBuckets {
+		return nil
+	}
+	starts := r.bySent.starts()
+	means := make([]float64, len(starts))
+	for i, start := range starts {
+		means[i] = r.bySent.buckets[start].Mean()
+	}
+	truncation := mser(means)
+
+	// Buckets are always t-digests, see bucketCompression.
+	digest, _ := tdigest.New(tdigest.Compression(1000))
+	merged := &digestAggregator{digest: digest}
+	var warmUpMessages uint64
+	for i, start := range starts {
+		bucket := r.bySent.buckets[start].(*digestAggregator)
+		if i < truncation {
+			warmUpMessages += bucket.Count()
+			continue
+		}
+		merged.merge(bucket)
+	}
+	warmUpEnd := time.Unix(0, starts[truncation]).UTC()
+	return &SteadyStateResult{
+		Method:         steadyStateMser,
+		WarmUpEnd:      &warmUpEnd,
+		WarmUpMessages: warmUpMessages,
+		Latency:        r.request.summarize(merged, nil),
+	}
+}
+
+// mser returns the truncation point of a series by the marginal standard error rule: the number of
+// leading values whose removal minimizes the standard error of the mean of the rest. Only the first
+// half of the series is considered, as the rule is unstable when few values remain.
+func mser(series []float64) int {
+	best, bestStatistic := 0, 0.0
+	for d := 0; d <= len(series)/2; d++ {
+		rest := series[d:]
+		var sum float64
+		for _, value := range rest {
+			sum += value
+		}
+		mean := sum / float64(len(rest))
+		var sumOfSquares float64
+		for _, value := range rest {
+			sumOfSquares += (value - mean) * (value - mean)
+		}
+		statistic := sumOfSquares / float64(len(rest)*len(rest))
+		if d == 0 || statistic < bestStatistic {
+			best, bestStatistic = d, statistic
+		}
+	}
+	return best
+}
+
+func printSteadyState(testRunId string, result *SteadyStateResult) {
+	switch result.Method {
+	case steadyStateProducer:
+		fmt.Printf("testRunId %s, steady state leaves out %d messages stamped as warm-up by the producer\n",
+			testRunId, result.WarmUpMessages)
+	case steadyStateMser:
+		fmt.Printf("testRunId %s, steady state detected by MSER from %s, leaving out %d warm-up messages\n",
+			testRunId, result.WarmUpEnd.Format(time.RFC3339Nano), result.WarmUpMessages)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestMser(t *testing.T) {
+	// step is a series of warm-up values of 50 followed by steady values alternating between 10 and 11.
+	step := func(warmUp int, steady int) []float64 {
+		series := make([]float64, 0, warmUp+steady)
+		for i := 0; i < warmUp; i++ {
+			series = append(series, 50)
+		}
+		for i := 0; i < steady; i++ {
+			series = append(series, 10+float64(i%2))
+		}
+		return series
+	}
+	tests := []struct {
+		name   string
+		series []float64
+		want   int
+	}{
+		{name: "no warm-up", series: step(0, 20), want: 0},
+		{name: "step after 4 values", series: step(4, 20), want: 4},
+		{name: "step after 10 values", series: step(10, 20), want: 10},
+		{name: "decaying warm-up", series: append([]float64{40, 30, 20}, step(0, 20)...), want: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mser(test.series); got != test.want {
+				t.Errorf("expected truncation after %d values, got %d", test.want, got)
+			}
+		})
+	}
+}
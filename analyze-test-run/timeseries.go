@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// bucketCompression is the t-digest compression of each time series bucket. Buckets are always
+// t-digests, whatever the aggregator of the run, because an HDR histogram per bucket is too large.
+const bucketCompression = 100
+
+// timeSeries aggregates latencies in buckets of a fixed width, keyed by the Unix time in
+// nanoseconds at which the bucket starts.
+type timeSeries struct {
+	width   time.Duration
+	buckets map[int64]aggregator
+}
+
+// TimeSeriesResult holds the time series of a run, by the time messages were sent and by the time
+// they were received.
+type TimeSeriesResult struct {
+	BucketWidth string       `json:"bucket_width"`
+	BySent      []TimeBucket `json:"by_sent"`
+	ByReceived  []TimeBucket `json:"by_received"`
+}
+
+// TimeBucket holds the count and percentiles of the latencies in milliseconds of the messages sent
+// or received within a bucket.
+type TimeBucket struct {
+	Start       time.Time    `json:"start"`
+	Count       uint64       `json:"count"`
+	Percentiles []Percentile `json:"percentiles"`
+}
+
+func newTimeSeries(width time.Duration) *timeSeries {
+	return &timeSeries{width: width, buckets: make(map[int64]aggregator)}
+}
+
+// add adds a latency to the bucket of a time. It does nothing to a nil time series, so that runs
+// without time series need not keep one.
+func (s *timeSeries) add(at time.Time, latency float64) {
+	if s == nil {
+		return
+	}
+	start := at.Truncate(s.width).UnixNano()
+	if _, ok := s.buckets[start]; !ok {
+		s.buckets[start] = newAggregator(aggregatorTDigest, bucketCompression, 0)
+	}
+	s.buckets[start].Add(latency)
+}
+
+// starts returns the start times of the buckets in order.
+func (s *timeSeries) starts() []int64 {
+	starts := make([]int64, 0, len(s.buckets))
+	for start := range s.buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	return starts
+}
+
+// result returns the buckets in order of their start time. Buckets in which no message was sent or
+// received are left out rather than reported with a count of 0.
+func (s *timeSeries) result(quantiles []float64) []TimeBucket {
+	starts := s.starts()
+	buckets := make([]TimeBucket, len(starts))
+	for i, start := range starts {
+		a := s.buckets[start]
+		buckets[i] = TimeBucket{Start: time.Unix(0, start).UTC(), Count: a.Count()}
+		for _, quantile := range quantiles {
+			buckets[i].Percentiles = append(buckets[i].Percentiles, Percentile{Quantile: quantile, Value: a.Quantile(quantile)})
+		}
+	}
+	return buckets
+}
+
+// state serializes the buckets of a time series, keyed by their start time in decimal.
+func (s *timeSeries) state() map[string]aggregatorState {
+	if s == nil {
+		return nil
+	}
+	state := make(map[string]aggregatorState)
+	for start, bucket := range s.buckets {
+		state[strconv.FormatInt(start, 10)] = marshalAggregator(bucket)
+	}
+	return state
+}
+
+func (s *timeSeries) restore(state map[string]aggregatorState) error {
+	if s == nil {
+		return nil
+	}
+	for key, bucketState := range state {
+		start, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket start %s, %w", key, err)
+		}
+		if s.buckets[start], err = unmarshalAggregator(bucketState); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTimeSeries writes a time series as a table, one row per bucket.
+func writeTimeSeries(w io.Writer, buckets []TimeBucket) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if len(buckets) > 0 {
+		header := []string{"start", "count"}
+		for _, percentile := range buckets[0].Percentiles {
+			header = append(header, percentileName(percentile.Quantile))
+		}
+		fmt.Fprintln(table, strings.Join(header, "\t")+"\t")
+	}
+	for _, bucket := range buckets {
+		row := []string{bucket.Start.Format("15:04:05.000"), strconv.FormatUint(bucket.Count, 10)}
+		for _, percentile := range bucket.Percentiles {
+			row = append(row, fmt.Sprintf("%.3f", percentile.Value))
+		}
+		fmt.Fprintln(table, strings.Join(row, "\t")+"\t")
+	}
+	return table.Flush()
+}
+
+func printTimeSeries(testRunId string, result *TimeSeriesResult) {
+	for _, series := range []struct {
+		label   string
+		buckets []TimeBucket
+	}{{"send", result.BySent}, {"receive", result.ByReceived}} {
+		fmt.Printf("testRunId %s, latency in milliseconds by %s time, in buckets of %s:\n", testRunId, series.label, result.BucketWidth)
+		if err := writeTimeSeries(os.Stdout, series.buckets); err != nil {
+			fmt.Printf("testRunId %s, failed to write time series: %+v\n", testRunId, err)
+		}
+	}
+}
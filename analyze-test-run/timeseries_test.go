@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeSeriesBuckets(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		width      time.Duration
+		at         []time.Duration
+		wantStarts []time.Duration
+		wantCounts []uint64
+	}{
+		{name: "no messages", width: time.Second},
+		{
+			name:       "end of a bucket starts the next",
+			width:      time.Second,
+			at:         []time.Duration{0, 999 * time.Millisecond, time.Second},
+			wantStarts: []time.Duration{0, time.Second},
+			wantCounts: []uint64{2, 1},
+		},
+		{
+			name:       "empty buckets are left out",
+			width:      time.Second,
+			at:         []time.Duration{500 * time.Millisecond, 3500 * time.Millisecond, 3600 * time.Millisecond},
+			wantStarts: []time.Duration{0, 3 * time.Second},
+			wantCounts: []uint64{1, 2},
+		},
+		{
+			// Buckets are aligned to multiples of their width since the Unix epoch, not to the run.
+			name:       "aligned to the epoch",
+			width:      10 * time.Second,
+			at:         []time.Duration{7 * time.Second, 12 * time.Second},
+			wantStarts: []time.Duration{0, 10 * time.Second},
+			wantCounts: []uint64{1, 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			series := newTimeSeries(test.width)
+			for i, at := range test.at {
+				series.add(start.Add(at), float64(i))
+			}
+			buckets := series.result([]float64{0.5})
+			if len(buckets) != len(test.wantStarts) {
+				t.Fatalf("expected %d buckets, got %+v", len(test.wantStarts), buckets)
+			}
+			for i, bucket := range buckets {
+				if want := start.Add(test.wantStarts[i]); !bucket.Start.Equal(want) || bucket.Count != test.wantCounts[i] {
+					t.Errorf("expected bucket %d to start at %s with %d latencies, got %s with %d", i, want, test.wantCounts[i], bucket.Start, bucket.Count)
+				}
+				if len(bucket.Percentiles) != 1 {
+					t.Errorf("expected a percentile per quantile in bucket %d, got %+v", i, bucket.Percentiles)
+				}
+			}
+		})
+	}
+}
+
+func TestNilTimeSeries(t *testing.T) {
+	var series *timeSeries
+	series.add(time.Now(), 1)
+	if state := series.state(); state != nil {
+		t.Errorf("expected no state, got %v", state)
+	}
+	if err := series.restore(map[string]aggregatorState{"0": {}}); err != nil {
+		t.Errorf("expected restoring a nil time series to do nothing, got %v", err)
+	}
+}
@@ -1,19 +1,35 @@
 package main
 
 import (
+	"fmt"
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awskinesis"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 	"path"
+	"strconv"
 )
 
+// consumerTimeoutSeconds is the timeout of both consumer functions. The analyzer joins the REPORT
+// line of an invocation to its deliveries for at most this long.
+const consumerTimeoutSeconds = 15
+
+// streamShardCount is the number of shards of the stream, all of them billed during a run.
+const streamShardCount = 10
+
 type EventBenchmarkStackProps struct {
 	awscdk.StackProps
+	// QueueBatchSize and StreamBatchSize are the most messages or records given to a single consumer
+	// invocation. Both default to 1, so that each delivery is handled by an invocation of its own.
+	// Larger batches amortize invocations and change the latency measured, so runs with different
+	// batch sizes are not comparable.
+	QueueBatchSize  int
+	StreamBatchSize int
 }
 
 func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenchmarkStackProps) awscdk.Stack {
@@ -22,24 +38,55 @@ func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenc
 		sprops = props.StackProps
 	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
+	queueBatchSize, streamBatchSize := 1, 1
+	if props != nil && props.QueueBatchSize > 0 {
+		queueBatchSize = props.QueueBatchSize
+	}
+	if props != nil && props.StreamBatchSize > 0 {
+		streamBatchSize = props.StreamBatchSize
+	}
+
+	// Failure injection and simulated work settings shared by both consumers, all disabled by default.
+	consumerEnvironment := &map[string]*string{
+		"FAILURE_RATE":         jsii.String("0"),
+		"PANIC_RATE":           jsii.String("0"),
+		"TIMEOUT_RATE":         jsii.String("0"),
+		"POISON_MESSAGE_EVERY": jsii.String("0"),
+		"WORK_CPU_MS":          jsii.String("0"),
+		"WORK_SLEEP_MS":        jsii.String("0"),
+		"WORK_ALLOC_MB":        jsii.String("0"),
+	}
+
+	// Messages that fail five deliveries, e.g. poison messages, are moved to the dead-letter queue
+	// rather than redelivered until they expire. Without failure injection no message fails, so it
+	// does not change what is measured.
+	deadLetterQueue := awssqs.NewQueue(stack, jsii.String("InputDeadLetterQueue"), &awssqs.QueueProps{
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(1)),
+	})
 
 	queue := awssqs.NewQueue(stack, jsii.String("InputQueue"), &awssqs.QueueProps{
 		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number(300)),
+		DeadLetterQueue: &awssqs.DeadLetterQueue{
+			Queue:           deadLetterQueue,
+			MaxReceiveCount: jsii.Number(5),
+		},
 	})
 
 	queueConsumerLambda := awslambda.NewFunction(stack, jsii.String("QueueConsumerFunction"), &awslambda.FunctionProps{
 		Runtime:         awslambda.Runtime_PROVIDED_AL2(),
 		MemorySize:      jsii.Number(128),
-		Timeout:         awscdk.Duration_Seconds(jsii.Number(15)),
+		Timeout:         awscdk.Duration_Seconds(jsii.Number(consumerTimeoutSeconds)),
 		Handler:         jsii.String("queue-consumer"),
 		Architecture:    awslambda.Architecture_ARM_64(),
 		Code:            awslambda.Code_FromAsset(jsii.String(path.Join("..", "queue-consumer", "build")), nil),
 		InsightsVersion: awslambda.LambdaInsightsVersion_VERSION_1_0_135_0(),
+		Environment:     consumerEnvironment,
 	})
 
 	queueConsumerLambda.AddEventSource(awslambdaeventsources.NewSqsEventSource(queue, &awslambdaeventsources.SqsEventSourceProps{
-		BatchSize: jsii.Number(1),
-		Enabled:   jsii.Bool(true),
+		BatchSize:               jsii.Number(float64(queueBatchSize)),
+		Enabled:                 jsii.Bool(true),
+		ReportBatchItemFailures: jsii.Bool(true),
 	}))
 
 	queueProducerLambda := awslambda.NewFunction(stack, jsii.String("QueueProducerFunction"), &awslambda.FunctionProps{
@@ -54,6 +101,8 @@ func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenc
 			"REGION":             stack.Region(),
 			"QUEUE_URL":          queue.QueueUrl(),
 			"NUMBER_OF_MESSAGES": jsii.String("10000"),
+			"WARM_UP_MESSAGES":   jsii.String("0"),
+			"WARM_UP_DURATION":   jsii.String("0s"),
 		},
 	})
 	queue.GrantSendMessages(queueProducerLambda.Role())
@@ -61,7 +110,7 @@ func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenc
 	stream := awskinesis.NewStream(stack, jsii.String("Stream"), &awskinesis.StreamProps{
 		RetentionPeriod: awscdk.Duration_Days(jsii.Number(1)),
 		StreamMode:      awskinesis.StreamMode_PROVISIONED,
-		ShardCount:      jsii.Number(10),
+		ShardCount:      jsii.Number(streamShardCount),
 		StreamName:      jsii.String("EventBenchmarkStream"),
 	})
 
@@ -73,11 +122,12 @@ func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenc
 	streamConsumerLambda := awslambda.NewFunction(stack, jsii.String("StreamConsumerFunction"), &awslambda.FunctionProps{
 		Runtime:         awslambda.Runtime_PROVIDED_AL2(),
 		MemorySize:      jsii.Number(128),
-		Timeout:         awscdk.Duration_Seconds(jsii.Number(15)),
+		Timeout:         awscdk.Duration_Seconds(jsii.Number(consumerTimeoutSeconds)),
 		Handler:         jsii.String("queue-consumer"),
 		Architecture:    awslambda.Architecture_ARM_64(),
 		Code:            awslambda.Code_FromAsset(jsii.String(path.Join("..", "stream-consumer", "build")), nil),
 		InsightsVersion: awslambda.LambdaInsightsVersion_VERSION_1_0_135_0(),
+		Environment:     consumerEnvironment,
 	})
 
 	streamProducerLambda := awslambda.NewFunction(stack, jsii.String("StreamProducerFunction"), &awslambda.FunctionProps{
@@ -92,16 +142,24 @@ func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenc
 			"REGION":             stack.Region(),
 			"STREAM_NAME":        stream.StreamName(),
 			"NUMBER_OF_MESSAGES": jsii.String("10000"),
+			"WARM_UP_MESSAGES":   jsii.String("0"),
+			"WARM_UP_DURATION":   jsii.String("0s"),
 		},
 	})
 	stream.GrantWrite(streamProducerLambda.Role())
+	// Failed batches are split to isolate the failing record and retried at most five times, so that
+	// a poison record does not block its shard until it expires. Without failure injection no batch
+	// fails.
 	awslambda.NewEventSourceMapping(stack, jsii.String("stream-consumer-mapping"), &awslambda.EventSourceMappingProps{
-		EventSourceArn:        streamConsumer.AttrConsumerArn(),
-		BatchSize:             jsii.Number(1),
-		StartingPosition:      awslambda.StartingPosition_TRIM_HORIZON,
-		Enabled:               jsii.Bool(true),
-		ParallelizationFactor: jsii.Number(10),
-		Target:                streamConsumerLambda,
+		EventSourceArn:          streamConsumer.AttrConsumerArn(),
+		BatchSize:               jsii.Number(float64(streamBatchSize)),
+		StartingPosition:        awslambda.StartingPosition_TRIM_HORIZON,
+		Enabled:                 jsii.Bool(true),
+		ParallelizationFactor:   jsii.Number(10),
+		ReportBatchItemFailures: jsii.Bool(true),
+		BisectBatchOnError:      jsii.Bool(true),
+		RetryAttempts:           jsii.Number(5),
+		Target:                  streamConsumerLambda,
 	})
 
 	stream.GrantRead(streamConsumerLambda.Role())
@@ -112,26 +170,90 @@ func EventBenchmarkStack(scope constructs.Construct, id string, props *EventBenc
 		Resources: &resources,
 	}))
 
+	resultsBucket := awss3.NewBucket(stack, jsii.String("ResultsBucket"), &awss3.BucketProps{
+		LifecycleRules: &[]*awss3.LifecycleRule{
+			{
+				Prefix:     jsii.String("checkpoints/"),
+				Expiration: awscdk.Duration_Days(jsii.Number(7)),
+			},
+		},
+	})
+
 	analyzeTestRunLambda := awslambda.NewFunction(stack, jsii.String("AnalyzeTestRunFunction"), &awslambda.FunctionProps{
 		Runtime:         awslambda.Runtime_PROVIDED_AL2(),
 		MemorySize:      jsii.Number(128),
-		Timeout:         awscdk.Duration_Minutes(jsii.Number(1)),
+		Timeout:         awscdk.Duration_Minutes(jsii.Number(5)),
 		Handler:         jsii.String("bootstrap"),
 		Architecture:    awslambda.Architecture_ARM_64(),
 		Code:            awslambda.Code_FromAsset(jsii.String(path.Join("..", "analyze-test-run", "build")), nil),
 		InsightsVersion: awslambda.LambdaInsightsVersion_VERSION_1_0_135_0(),
 		Environment: &map[string]*string{
 			"REGION":                           stack.Region(),
+			"STACK_NAME":                       stack.StackName(),
 			"QUEUE_CLOUDWATCH_LOGS_LOG_GROUP":  queueConsumerLambda.LogGroup().LogGroupName(),
 			"STREAM_CLOUDWATCH_LOGS_LOG_GROUP": streamConsumerLambda.LogGroup().LogGroupName(),
+			// The queue and stream of the transports, for the service metrics of each run.
+			"QUEUE_NAME":           queue.QueueName(),
+			"STREAM_NAME":          stream.StreamName(),
+			"STREAM_CONSUMER_NAME": streamConsumer.ConsumerName(),
+			"STREAM_SHARD_COUNT":   jsii.String(strconv.Itoa(streamShardCount)),
+			"CONSUMER_TIMEOUT":     jsii.String(strconv.Itoa(consumerTimeoutSeconds) + "s"),
+			// Comma-separated Output fields to group percentiles by, e.g. "shard_id,batch_size".
+			"GROUP_BY": jsii.String(""),
+			// Either "insights" for Logs Insights queries or "filter" for exact FilterLogEvents paging.
+			"ANALYZER_BACKEND": jsii.String("insights"),
+			"RESULTS_BUCKET":   resultsBucket.BucketName(),
+			// Pushgateway URL, e.g. "http://pushgateway:9091/metrics/job/event-benchmark", to push run
+			// summaries to in OpenMetrics format.
+			"OPENMETRICS_ENDPOINT": jsii.String(""),
+			// InfluxDB write URL, e.g. "http://influxdb:8086/api/v2/write?org=benchmark&bucket=runs", to
+			// write run summaries to in line protocol, authenticated with INFLUX_TOKEN if set.
+			"INFLUX_ENDPOINT": jsii.String(""),
+			// Prices by region as JSON, for the cost estimates of regions without default prices.
+			"PRICE_TABLE": jsii.String(""),
 		},
 	})
-	queueConsumerLambda.LogGroup().Grant(analyzeTestRunLambda.Role(),
-		jsii.String("logs:FilterLogEvents"),
-	)
-	streamConsumerLambda.LogGroup().Grant(analyzeTestRunLambda.Role(),
-		jsii.String("logs:FilterLogEvents"),
-	)
+	// The analyzer discovers consumer functions from the stack, so it may read the log group of any
+	// function in the stack rather than only the ones that exist today.
+	analyzeTestRunLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions: &[]*string{
+			jsii.String("logs:FilterLogEvents"),
+			jsii.String("logs:StartQuery"),
+		},
+		Resources: &[]*string{stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("logs"),
+			Resource:     jsii.String("log-group"),
+			ResourceName: awscdk.Fn_Join(jsii.String(""), &[]*string{jsii.String("/aws/lambda/"), stack.StackName(), jsii.String("-*")}),
+			ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+		})},
+	}))
+	analyzeTestRunLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   &[]*string{jsii.String("cloudformation:DescribeStackResources")},
+		Resources: &[]*string{stack.StackId()},
+	}))
+	// Queries are not scoped to a log group, so GetQueryResults and StopQuery cannot be granted per
+	// log group.
+	analyzeTestRunLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   &[]*string{jsii.String("logs:GetQueryResults"), jsii.String("logs:StopQuery")},
+		Resources: &[]*string{jsii.String("*")},
+	}))
+	// Metric data is not scoped to a resource, so GetMetricData can only be granted on every metric.
+	analyzeTestRunLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   &[]*string{jsii.String("cloudwatch:GetMetricData")},
+		Resources: &[]*string{jsii.String("*")},
+	}))
+	resultsBucket.GrantReadWrite(analyzeTestRunLambda.Role(), nil)
+	// The analyzer hands off to itself to resume long analyses. Granting it its own ARN would be a
+	// circular dependency, so it may invoke the functions named after the stack, as CDK names them.
+	analyzeTestRunLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions: &[]*string{jsii.String("lambda:InvokeFunction")},
+		Resources: &[]*string{stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("lambda"),
+			Resource:     jsii.String("function"),
+			ResourceName: awscdk.Fn_Join(jsii.String(""), &[]*string{stack.StackName(), jsii.String("-*")}),
+			ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+		})},
+	}))
 
 	return stack
 }
@@ -142,14 +264,33 @@ func main() {
 	app := awscdk.NewApp(nil)
 
 	EventBenchmarkStack(app, "EventBenchmarkStack", &EventBenchmarkStackProps{
-		awscdk.StackProps{
+		StackProps: awscdk.StackProps{
 			Env: env(),
 		},
+		QueueBatchSize:  contextInt(app, "queueBatchSize"),
+		StreamBatchSize: contextInt(app, "streamBatchSize"),
 	})
 
 	app.Synth(nil)
 }
 
+// contextInt reads an integer from the CDK context, e.g. "cdk deploy -c queueBatchSize=10", or from
+// cdk.json. It returns 0 when the key is not set.
+func contextInt(app awscdk.App, key string) int {
+	switch value := app.Node().TryGetContext(jsii.String(key)).(type) {
+	case float64:
+		return int(value)
+	case string:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			panic(fmt.Sprintf("context %s must be an integer, got %q", key, value))
+		}
+		return parsed
+	default:
+		return 0
+	}
+}
+
 // env determines the AWS environment (account+region) in which our stack is to
 // be deployed. For more information see: https://docs.aws.amazon.com/cdk/latest/guide/environments.html
 func env() *awscdk.Environment {
@@ -23,3 +23,33 @@ func TestInfraStack(t *testing.T) {
 	})
 	template.ResourceCountIs(jsii.String("AWS::SNS::Topic"), jsii.Number(1))
 }
+
+func TestInfraStackBatchSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		props  *EventBenchmarkStackProps
+		queue  int
+		stream int
+	}{
+		{name: "default", props: nil, queue: 1, stream: 1},
+		{name: "explicit", props: &EventBenchmarkStackProps{QueueBatchSize: 10, StreamBatchSize: 100}, queue: 10, stream: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := awscdk.NewApp(nil)
+			stack := EventBenchmarkStack(app, "MyStack", test.props)
+			template := assertions.Template_FromStack(stack, nil)
+
+			template.HasResourceProperties(jsii.String("AWS::Lambda::EventSourceMapping"), map[string]interface{}{
+				"BatchSize":             test.queue,
+				"StartingPosition":      assertions.Match_Absent(),
+				"FunctionResponseTypes": []interface{}{"ReportBatchItemFailures"},
+			})
+			template.HasResourceProperties(jsii.String("AWS::Lambda::EventSourceMapping"), map[string]interface{}{
+				"BatchSize":                  test.stream,
+				"StartingPosition":           "TRIM_HORIZON",
+				"BisectBatchOnFunctionError": true,
+			})
+		})
+	}
+}
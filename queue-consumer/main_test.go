@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// setFailures injects failures for the duration of a test, with every other setting disabled.
+func setFailures(t *testing.T, rate float64, every int) {
+	previousRate, previousEvery := failureRate, poisonMessageEvery
+	t.Cleanup(func() { failureRate, poisonMessageEvery = previousRate, previousEvery })
+	failureRate, poisonMessageEvery = rate, every
+}
+
+func TestShouldFail(t *testing.T) {
+	tests := []struct {
+		name          string
+		failureRate   float64
+		poisonEvery   int
+		messageNumber int
+		want          bool
+	}{
+		{name: "no failures", messageNumber: 0, want: false},
+		{name: "every message fails", failureRate: 1, messageNumber: 0, want: true},
+		{name: "first message is not poison", poisonEvery: 3, messageNumber: 0, want: false},
+		{name: "second message is not poison", poisonEvery: 3, messageNumber: 1, want: false},
+		{name: "third message is poison", poisonEvery: 3, messageNumber: 2, want: true},
+		{name: "sixth message is poison", poisonEvery: 3, messageNumber: 5, want: true},
+		{name: "every message is poison", poisonEvery: 1, messageNumber: 0, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFailures(t, test.failureRate, test.poisonEvery)
+			if got := shouldFail(Datum{MessageNumber: test.messageNumber}); got != test.want {
+				t.Errorf("expected message %d to fail = %v, got %v", test.messageNumber, test.want, got)
+			}
+		})
+	}
+}
+
+func sqsEvent(messages int) events.SQSEvent {
+	var event events.SQSEvent
+	for i := 0; i < messages; i++ {
+		body, _ := json.Marshal(Datum{TestRunId: "run", TimeSent: time.Now().Format(time.RFC3339Nano), MessageNumber: i})
+		event.Records = append(event.Records, events.SQSMessage{MessageId: fmt.Sprintf("message-%d", i), Body: string(body)})
+	}
+	return event
+}
+
+func TestHandlerReportsFailedMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		failureRate float64
+		poisonEvery int
+		want        []string
+	}{
+		{name: "no failures", want: nil},
+		{name: "every message fails", failureRate: 1, want: []string{"message-0", "message-1", "message-2", "message-3", "message-4", "message-5"}},
+		// The messages after a failure are still processed, so both poison messages are reported.
+		{name: "every third message is poison", poisonEvery: 3, want: []string{"message-2", "message-5"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFailures(t, test.failureRate, test.poisonEvery)
+			response, err := handler(context.Background(), sqsEvent(6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, failure := range response.BatchItemFailures {
+				got = append(got, failure.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected failures %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSimulateWork(t *testing.T) {
+	tests := []struct {
+		name    string
+		datum   Datum
+		atLeast time.Duration
+		atMost  time.Duration
+	}{
+		{name: "no work", datum: Datum{}, atLeast: 0, atMost: 10 * time.Millisecond},
+		{name: "cpu", datum: Datum{WorkCpuMs: 20}, atLeast: 20 * time.Millisecond, atMost: time.Second},
+		{name: "sleep", datum: Datum{WorkSleepMs: 20}, atLeast: 20 * time.Millisecond, atMost: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if duration := simulateWork(test.datum); duration < test.atLeast || duration > test.atMost {
+				t.Errorf("expected work of %s to %s, took %s", test.atLeast, test.atMost, duration)
+			}
+		})
+	}
+}
@@ -2,4 +2,4 @@ module stream-consumer
 
 go 1.19
 
-require github.com/aws/aws-lambda-go v1.35.0
+require github.com/aws/aws-lambda-go v1.36.0
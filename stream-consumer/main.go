@@ -1,28 +1,129 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"time"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+var (
+	failureRate        float64
+	panicRate          float64
+	timeoutRate        float64
+	poisonMessageEvery int
+	workCpuMs          int
+	workSleepMs        int
+	workAllocMb        int
+
+	// coldStart is true until the first invocation of the execution environment. Its init duration
+	// is reported by the platform in the REPORT line of that invocation, which the analyzer joins by
+	// request ID.
+	coldStart = true
+	// random draws the injected failures, seeded differently in every execution environment.
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
 
 type Datum struct {
 	TestRunId     string `json:"test_run_id"`
 	TimeSent      string `json:"time_sent"`
 	MessageNumber int    `json:"message_number"`
+	WorkCpuMs     int    `json:"work_cpu_ms,omitempty"`
+	WorkSleepMs   int    `json:"work_sleep_ms,omitempty"`
+	WorkAllocMb   int    `json:"work_alloc_mb,omitempty"`
 }
 
 type Output struct {
-	TestRunId  string `json:"test_run_id"`
-	EventId    string `json:"event_id"`
-	Body       string `json:"body"`
-	TimeDiffNs int    `json:"time_diff_ns"`
+	TestRunId      string `json:"test_run_id"`
+	EventId        string `json:"event_id"`
+	Body           string `json:"body"`
+	TimeDiffNs     int    `json:"time_diff_ns"`
+	WorkDurationNs int    `json:"work_duration_ns"`
+	RequestId      string `json:"request_id"`
+	ColdStart      bool   `json:"cold_start"`
+
+	FunctionMemorySize int    `json:"function_memory_size"`
+	Architecture       string `json:"architecture"`
+	ShardId            string `json:"shard_id"`
+	SequenceNumber     string `json:"sequence_number"`
+	BatchIndex         int    `json:"batch_index"`
+	BatchSize          int    `json:"batch_size"`
+	HandlerStartTime   string `json:"handler_start_time"`
+
+	MessageNumber int    `json:"message_number"`
+	PartitionKey  string `json:"partition_key"`
+}
+
+// injectInvocationFailure fails the whole batch, either by panicking or by running past the
+// invocation deadline, so that Lambda retries it (bisecting it first if configured to).
+func injectInvocationFailure(ctx context.Context) {
+	if random.Float64() < panicRate {
+		panic("injected panic")
+	}
+	if random.Float64() < timeoutRate {
+		deadline, _ := ctx.Deadline()
+		fmt.Printf("injected timeout, sleeping until past deadline %s\n", deadline.Format(time.RFC3339Nano))
+		time.Sleep(time.Until(deadline) + time.Second)
+	}
 }
 
-func handler(event events.KinesisEvent) error {
-	for _, record := range event.Records {
+// simulateWork models the cost of a real handler by spinning the CPU, sleeping in place of I/O and
+// allocating memory, in that order. Amounts set in the message take precedence over the env vars.
+func simulateWork(datum Datum) time.Duration {
+	start := time.Now()
+	cpuMs, sleepMs, allocMb := workCpuMs, workSleepMs, workAllocMb
+	if datum.WorkCpuMs > 0 {
+		cpuMs = datum.WorkCpuMs
+	}
+	if datum.WorkSleepMs > 0 {
+		sleepMs = datum.WorkSleepMs
+	}
+	if datum.WorkAllocMb > 0 {
+		allocMb = datum.WorkAllocMb
+	}
+	spinUntil := start.Add(time.Duration(cpuMs) * time.Millisecond)
+	for time.Now().Before(spinUntil) {
+	}
+	time.Sleep(time.Duration(sleepMs) * time.Millisecond)
+	if allocMb > 0 {
+		// Touch every page so the allocation is actually backed by memory.
+		buffer := make([]byte, allocMb<<20)
+		for i := 0; i < len(buffer); i += os.Getpagesize() {
+			buffer[i] = 1
+		}
+	}
+	return time.Since(start)
+}
+
+// shouldFail reports whether processing of a single record should fail. Poison messages fail on
+// every delivery, other records fail at random with probability failureRate.
+func shouldFail(datum Datum) bool {
+	if poisonMessageEvery > 0 && (datum.MessageNumber+1)%poisonMessageEvery == 0 {
+		return true
+	}
+	return random.Float64() < failureRate
+}
+
+func handler(ctx context.Context, event events.KinesisEvent) (events.KinesisEventResponse, error) {
+	handlerStartTime := time.Now()
+	var response events.KinesisEventResponse
+	var requestId string
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		requestId = lc.AwsRequestID
+	}
+	cold := coldStart
+	coldStart = false
+	injectInvocationFailure(ctx)
+	for i, record := range event.Records {
 		dataSerialized := record.Kinesis.Data
 		var datum Datum
 		err := json.Unmarshal(dataSerialized, &datum)
@@ -37,18 +138,80 @@ func handler(event events.KinesisEvent) error {
 			continue
 		}
 		timeDiff := time.Now().Sub(timeSent)
+		workDuration := simulateWork(datum)
+		if shouldFail(datum) {
+			// Break, not continue as on SQS: Lambda checkpoints at the failure and redelivers the rest.
+			fmt.Printf("testRunId %s eventId %s: injected failure\n", testRunId, record.EventID)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.KinesisBatchItemFailure{
+				ItemIdentifier: record.Kinesis.SequenceNumber,
+			})
+			break
+		}
 		output := Output{
-			TestRunId:  testRunId,
-			EventId:    record.EventID,
-			Body:       string(record.Kinesis.Data),
-			TimeDiffNs: int(timeDiff.Nanoseconds()),
+			TestRunId:      testRunId,
+			EventId:        record.EventID,
+			Body:           string(record.Kinesis.Data),
+			TimeDiffNs:     int(timeDiff.Nanoseconds()),
+			WorkDurationNs: int(workDuration.Nanoseconds()),
+			RequestId:      requestId,
+			ColdStart:      cold,
+
+			FunctionMemorySize: lambdacontext.MemoryLimitInMB,
+			Architecture:       runtime.GOARCH,
+			ShardId:            shardId(record),
+			SequenceNumber:     record.Kinesis.SequenceNumber,
+			BatchIndex:         i,
+			BatchSize:          len(event.Records),
+			HandlerStartTime:   handlerStartTime.Format(time.RFC3339Nano),
+
+			MessageNumber: datum.MessageNumber,
+			PartitionKey:  record.Kinesis.PartitionKey,
 		}
 		outputSerialized, _ := json.Marshal(output)
 		fmt.Printf("%s\n", string(outputSerialized))
 	}
-	return nil
+	return response, nil
+}
+
+// shardId extracts the shard ID from the event ID, which has the form "shardId-000000000000:<sequence number>".
+func shardId(record events.KinesisEventRecord) string {
+	return strings.SplitN(record.EventID, ":", 2)[0]
+}
+
+func floatFromEnv(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func intFromEnv(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		panic(err)
+	}
+	return i
 }
 
 func main() {
+	failureRate = floatFromEnv("FAILURE_RATE")
+	panicRate = floatFromEnv("PANIC_RATE")
+	timeoutRate = floatFromEnv("TIMEOUT_RATE")
+	// Every Nth message of a run is poison, counting from 1: message numbers N-1, 2N-1 and so on. The
+	// first message of a run is only poison when N is 1, so that runs do not start with a retry.
+	poisonMessageEvery = intFromEnv("POISON_MESSAGE_EVERY")
+	workCpuMs = intFromEnv("WORK_CPU_MS")
+	workSleepMs = intFromEnv("WORK_SLEEP_MS")
+	workAllocMb = intFromEnv("WORK_ALLOC_MB")
+
 	lambda.Start(handler)
 }
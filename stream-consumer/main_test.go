@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// setFailures injects failures for the duration of a test, with every other setting disabled.
+func setFailures(t *testing.T, rate float64, every int) {
+	previousRate, previousEvery := failureRate, poisonMessageEvery
+	t.Cleanup(func() { failureRate, poisonMessageEvery = previousRate, previousEvery })
+	failureRate, poisonMessageEvery = rate, every
+}
+
+func TestShouldFail(t *testing.T) {
+	tests := []struct {
+		name          string
+		failureRate   float64
+		poisonEvery   int
+		messageNumber int
+		want          bool
+	}{
+		{name: "no failures", messageNumber: 0, want: false},
+		{name: "every record fails", failureRate: 1, messageNumber: 0, want: true},
+		{name: "first record is not poison", poisonEvery: 3, messageNumber: 0, want: false},
+		{name: "second record is not poison", poisonEvery: 3, messageNumber: 1, want: false},
+		{name: "third record is poison", poisonEvery: 3, messageNumber: 2, want: true},
+		{name: "sixth record is poison", poisonEvery: 3, messageNumber: 5, want: true},
+		{name: "every record is poison", poisonEvery: 1, messageNumber: 0, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFailures(t, test.failureRate, test.poisonEvery)
+			if got := shouldFail(Datum{MessageNumber: test.messageNumber}); got != test.want {
+				t.Errorf("expected record %d to fail = %v, got %v", test.messageNumber, test.want, got)
+			}
+		})
+	}
+}
+
+func kinesisEvent(records int) events.KinesisEvent {
+	var event events.KinesisEvent
+	for i := 0; i < records; i++ {
+		data, _ := json.Marshal(Datum{TestRunId: "run", TimeSent: time.Now().Format(time.RFC3339Nano), MessageNumber: i})
+		record := events.KinesisEventRecord{EventID: fmt.Sprintf("shardId-000000000000:%d", i)}
+		record.Kinesis.Data = data
+		record.Kinesis.SequenceNumber = fmt.Sprintf("%d", i)
+		event.Records = append(event.Records, record)
+	}
+	return event
+}
+
+func TestHandlerReportsFirstFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		failureRate float64
+		poisonEvery int
+		want        []string
+	}{
+		{name: "no failures", want: nil},
+		{name: "every record fails", failureRate: 1, want: []string{"0"}},
+		// Lambda redelivers the batch from the first failure, so the second poison record is not
+		// reached.
+		{name: "every third record is poison", poisonEvery: 3, want: []string{"2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFailures(t, test.failureRate, test.poisonEvery)
+			response, err := handler(context.Background(), kinesisEvent(6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, failure := range response.BatchItemFailures {
+				got = append(got, failure.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected failures at sequence numbers %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSimulateWork(t *testing.T) {
+	tests := []struct {
+		name    string
+		datum   Datum
+		atLeast time.Duration
+		atMost  time.Duration
+	}{
+		{name: "no work", datum: Datum{}, atLeast: 0, atMost: 10 * time.Millisecond},
+		{name: "cpu", datum: Datum{WorkCpuMs: 20}, atLeast: 20 * time.Millisecond, atMost: time.Second},
+		{name: "sleep", datum: Datum{WorkSleepMs: 20}, atLeast: 20 * time.Millisecond, atMost: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if duration := simulateWork(test.datum); duration < test.atLeast || duration > test.atMost {
+				t.Errorf("expected work of %s to %s, took %s", test.atLeast, test.atMost, duration)
+			}
+		})
+	}
+}
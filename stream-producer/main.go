@@ -20,26 +20,38 @@ import (
 var (
 	streamName       string
 	numberOfMessages int
-	cfg              aws.Config
+	// Messages are stamped as warm-up while their message number is below warmUpMessages, or until
+	// warmUpDuration has passed since the run started, so the analyzer can leave them out.
+	warmUpMessages int
+	warmUpDuration time.Duration
+	cfg            aws.Config
 )
 
 type Datum struct {
 	TestRunId     string `json:"test_run_id"`
 	TimeSent      string `json:"time_sent"`
 	MessageNumber int    `json:"message_number"`
+	WarmUp        bool   `json:"warm_up,omitempty"`
+	// RunStart is when the run started, the same in every message of the run, so that the analyzer
+	// knows it from any delivery.
+	RunStart string `json:"run_start"`
 }
 
-func worker(id int, testRunId string, batchNumbers <-chan int, results chan<- bool) {
+func worker(id int, testRunId string, runStart time.Time, batchNumbers <-chan int, results chan<- bool) {
 	kinesisClient := kinesis.NewFromConfig(cfg, func(o *kinesis.Options) {})
 	fmt.Printf("worker id %d start\n", id)
 	for batchNumber := range batchNumbers {
 		fmt.Printf("worker id %d starting batch %d...\n", id, batchNumber)
 		entries := make([]types.PutRecordsRequestEntry, 10)
 		for j := 0; j < 10; j++ {
+			timeSent := time.Now()
+			messageNumber := batchNumber*10 + j
 			datum := Datum{
 				TestRunId:     testRunId,
-				TimeSent:      time.Now().Format(time.RFC3339Nano),
-				MessageNumber: batchNumber*10 + j,
+				TimeSent:      timeSent.Format(time.RFC3339Nano),
+				MessageNumber: messageNumber,
+				WarmUp:        messageNumber < warmUpMessages || timeSent.Sub(runStart) < warmUpDuration,
+				RunStart:      runStart.Format(time.RFC3339Nano),
 			}
 			serialized, _ := json.Marshal(datum)
 			entry := types.PutRecordsRequestEntry{
@@ -71,12 +83,13 @@ func worker(id int, testRunId string, batchNumbers <-chan int, results chan<- bo
 
 func handler() error {
 	testRunId := uuid.NewString()
+	runStart := time.Now()
 	numberOfBatches := numberOfMessages / 10
 	batchNumbers := make(chan int, numberOfBatches)
 	results := make(chan bool, numberOfBatches)
 	numWorkers := runtime.NumCPU()
 	for w := 1; w <= numWorkers; w++ {
-		go worker(w, testRunId, batchNumbers, results)
+		go worker(w, testRunId, runStart, batchNumbers, results)
 	}
 	for i := 0; i <= numberOfMessages/10; i++ {
 		batchNumbers <- i
@@ -98,6 +111,18 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if value := os.Getenv("WARM_UP_MESSAGES"); value != "" {
+		warmUpMessages, err = strconv.Atoi(value)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if value := os.Getenv("WARM_UP_DURATION"); value != "" {
+		warmUpDuration, err = time.ParseDuration(value)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	cfg, err = config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion(region),